@@ -4,16 +4,21 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"time"
 
 	"log"
 
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 var ICON_TERMINATED = "\xE2\x98\xA0"        // skull n bones
@@ -21,6 +26,30 @@ var ICON_RUNNING = "\xF0\x9F\x8D\xBB"       // cheers w/ beers
 var ICON_SHUTTING_DOWN = "\xF0\x9F\x92\xA3" // bombora
 var ICON_DEFAULT = "\xF0\x9F\x92\xA9"       // smiling poo (what else)
 
+// tags terrafire writes on everything it launches, and uses to find it again
+const (
+	TagName           = "Name"
+	TagLauncher       = "Launcher"
+	TagGroup          = "TerrafireGroup"
+	LauncherTerrafire = "Terrafire"
+)
+
+// provenance tags, where an instance came from
+const (
+	TagTier       = "TerrafireTier"
+	TagLaunchedAt = "TerrafireLaunchedAt"
+	TagLaunchedBy = "TerrafireLaunchedBy"
+	TagVersion    = "TerrafireVersion"
+	TagConfigHash = "TerrafireConfigHash"
+)
+
+// ReservedTags - tags only terrafire may set, user tags can't override them
+var ReservedTags = []string{TagName, TagLauncher, TagGroup, TagTier, TagLaunchedAt, TagLaunchedBy, TagVersion, TagConfigHash}
+
+// WaitInterval and WaitAttempts - how often and how many times WaitForInstanceState polls
+var WaitInterval = 5 * time.Second
+var WaitAttempts = 120
+
 // CreateAWSSession - create a re-usable AWS session
 func CreateAWSSession() *session.Session {
 	sess, err := session.NewSession()
@@ -30,20 +59,90 @@ func CreateAWSSession() *session.Session {
 	return sess
 }
 
-// CreateEC2Service - create a re-usable AWS EC2 service
-func CreateEC2Service(region string, sesh *session.Session) *ec2.EC2 {
-	return ec2.New(sesh, &aws.Config{Region: aws.String(region)})
+// CreateEC2Service - create a re-usable AWS EC2 service, an empty endpoint uses the AWS default
+func CreateEC2Service(region string, endpoint string, sesh *session.Session) *ec2.EC2 {
+	conf := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		conf.Endpoint = aws.String(endpoint)
+	}
+	return ec2.New(sesh, conf)
 }
 
-// CreateRoute53Service - create a re-usable AWS EC2 service
-func CreateRoute53Service(sesh *session.Session) *route53.Route53 {
+// CreateRoute53Service - create a re-usable AWS Route53 service, an empty endpoint uses the AWS default, a custom one needs the region
+func CreateRoute53Service(region string, endpoint string, sesh *session.Session) *route53.Route53 {
+	if endpoint != "" {
+		return route53.New(sesh, &aws.Config{Region: aws.String(region), Endpoint: aws.String(endpoint)})
+	}
 	return route53.New(sesh)
 }
 
+// CreateSTSService - create a re-usable AWS STS service, an empty endpoint uses the AWS default
+func CreateSTSService(region string, endpoint string, sesh *session.Session) *sts.STS {
+	conf := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		conf.Endpoint = aws.String(endpoint)
+	}
+	return sts.New(sesh, conf)
+}
+
+// CreateIAMService - create a re-usable AWS IAM service (IAM is global), an empty endpoint uses the AWS default, a custom one needs the region
+func CreateIAMService(region string, endpoint string, sesh *session.Session) *iam.IAM {
+	if endpoint != "" {
+		return iam.New(sesh, &aws.Config{Region: aws.String(region), Endpoint: aws.String(endpoint)})
+	}
+	return iam.New(sesh)
+}
+
+// Services - the AWS services a group's commands run against
+type Services struct {
+	EC2     EC2API
+	Route53 Route53API
+	STS     STSAPI
+	IAM     IAMAPI
+}
+
+// NewAWSServices - create the real AWS services for a region and set of endpoints
+func NewAWSServices(region string, endpoints Endpoints, sesh *session.Session) Services {
+	return Services{
+		EC2:     CreateEC2Service(region, endpoints.EC2, sesh),
+		Route53: CreateRoute53Service(region, endpoints.Route53, sesh),
+		STS:     CreateSTSService(region, endpoints.STS, sesh),
+		IAM:     CreateIAMService(region, endpoints.IAM, sesh),
+	}
+}
+
+// Provenance - who launched an apply's instances, when, and from which config, written as tags on everything launched
+type Provenance struct {
+	LaunchedBy string
+	LaunchedAt time.Time
+	ConfigHash string
+}
+
+// GetProvenance - the provenance for an apply starting now, the launching principal comes from STS
+func GetProvenance(svc STSAPI, configHash string) (Provenance, error) {
+	ident, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return Provenance{}, err
+	}
+	return Provenance{
+		LaunchedBy: aws.StringValue(ident.Arn),
+		LaunchedAt: time.Now().UTC(),
+		ConfigHash: configHash,
+	}, nil
+}
+
 // GetGroupInstances - get a group's instances via call to describe instances
-func GetGroupInstances(group GroupConfig, svc *ec2.EC2) ([]ec2.Instance, error) {
+func GetGroupInstances(group GroupConfig, svc EC2API) ([]ec2.Instance, error) {
+	return describeInstanceList(svc, CreateGroupInstanceFilter(group))
+}
+
+// GetTierInstances - get the instances in a group whose tier tag is the given tier
+func GetTierInstances(group GroupConfig, tier string, svc EC2API) ([]ec2.Instance, error) {
+	return describeInstanceList(svc, CreateTierInstanceFilter(group, tier))
+}
 
-	filter := CreateGroupInstanceFilter(group)
+// util - describe instances as a flat list
+func describeInstanceList(svc EC2API, filter *ec2.DescribeInstancesInput) ([]ec2.Instance, error) {
 	resp, err := svc.DescribeInstances(filter)
 	if err != nil {
 		return nil, err
@@ -59,22 +158,382 @@ func GetGroupInstances(group GroupConfig, svc *ec2.EC2) ([]ec2.Instance, error)
 }
 
 // util - create a run instance input based on our config
-func createRunInstanceInput(inst EC2Instance) *ec2.RunInstancesInput {
+func createRunInstanceInput(config RunConfig, inst EC2Instance) *ec2.RunInstancesInput {
 	netSpec := &ec2.InstanceNetworkInterfaceSpecification{
 		AssociatePublicIpAddress: aws.Bool(inst.AssociatePublicIP),
 		DeviceIndex:              aws.Int64(0),
-		SubnetId:                 aws.String(inst.Subnet),
-		Groups:                   aws.StringSlice(strings.Split(inst.SecGroups, ",")),
+		SubnetId:                 aws.String(inst.Subnet.ID),
+		Groups:                   aws.StringSlice(inst.SecGroups),
+	}
+	// tag everything at launch so a terrafire instance can never exist without its tags
+	tags := createInstanceTags(config, inst)
+	tagSpecs := make([]*ec2.TagSpecification, 0)
+	for _, resType := range []string{ec2.ResourceTypeInstance, ec2.ResourceTypeVolume, ec2.ResourceTypeNetworkInterface} {
+		tagSpecs = append(tagSpecs, &ec2.TagSpecification{
+			ResourceType: aws.String(resType),
+			Tags:         tags,
+		})
 	}
 	return &ec2.RunInstancesInput{
-		ImageId:           aws.String(inst.AMI),
-		InstanceType:      aws.String(inst.Type),
-		KeyName:           aws.String(inst.KeyName),
-		MaxCount:          aws.Int64(1),
-		MinCount:          aws.Int64(1),
-		UserData:          aws.String(inst.UserData),
-		NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{netSpec},
+		ImageId:               aws.String(inst.AMI.ID),
+		InstanceType:          aws.String(inst.Type),
+		KeyName:               aws.String(inst.KeyName),
+		MaxCount:              aws.Int64(1),
+		MinCount:              aws.Int64(1),
+		UserData:              aws.String(inst.UserData),
+		NetworkInterfaces:     []*ec2.InstanceNetworkInterfaceSpecification{netSpec},
+		TagSpecifications:     tagSpecs,
+		Placement:             createPlacement(inst),
+		BlockDeviceMappings:   createBlockDeviceMappings(inst),
+		IamInstanceProfile:    createInstanceProfileSpec(inst),
+		InstanceMarketOptions: createMarketOptions(config, inst),
+	}
+}
+
+// util - spot market options, nil for on-demand, stopping or hibernating needs a persistent request
+func createMarketOptions(config RunConfig, inst EC2Instance) *ec2.InstanceMarketOptionsRequest {
+	market, spot := config.InstanceMarket(inst)
+	if market != MarketSpot {
+		return nil
+	}
+	opts := &ec2.SpotMarketOptions{SpotInstanceType: aws.String(ec2.SpotInstanceTypeOneTime)}
+	if spot.MaxPrice != "" {
+		opts.MaxPrice = aws.String(spot.MaxPrice)
+	}
+	if spot.Interruption != "" {
+		opts.InstanceInterruptionBehavior = aws.String(spot.Interruption)
+		if spot.Interruption != ec2.InstanceInterruptionBehaviorTerminate {
+			opts.SpotInstanceType = aws.String(ec2.SpotInstanceTypePersistent)
+		}
+	}
+	return &ec2.InstanceMarketOptionsRequest{
+		MarketType:  aws.String(ec2.MarketTypeSpot),
+		SpotOptions: opts,
+	}
+}
+
+// util - true if a launch failed because there's no spot capacity (or not at the max price)
+func spotCapacityError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "InsufficientInstanceCapacity", "SpotMaxPriceTooLow", "MaxSpotInstanceCountExceeded":
+		return true
+	}
+	return false
+}
+
+// util - the instance profile by ARN or name, nil if the instance doesn't have one
+func createInstanceProfileSpec(inst EC2Instance) *ec2.IamInstanceProfileSpecification {
+	if inst.InstanceProfile == "" {
+		return nil
+	}
+	if strings.HasPrefix(inst.InstanceProfile, "arn:") {
+		return &ec2.IamInstanceProfileSpecification{Arn: aws.String(inst.InstanceProfile)}
+	}
+	return &ec2.IamInstanceProfileSpecification{Name: aws.String(inst.InstanceProfile)}
+}
+
+// FindSubnets - the subnets matching a subnet selector, its zone falls back to the given one
+func FindSubnets(svc EC2API, sel SubnetConfig, zone string) ([]*ec2.Subnet, error) {
+	ipt := &ec2.DescribeSubnetsInput{}
+	addFilter := func(name, value string) {
+		if value != "" {
+			ipt.Filters = append(ipt.Filters, &ec2.Filter{Name: aws.String(name), Values: []*string{aws.String(value)}})
+		}
+	}
+	if sel.Zone != "" {
+		zone = sel.Zone
+	}
+	addFilter("tag:Name", sel.Name)
+	addFilter("vpc-id", sel.VPC)
+	addFilter("availability-zone", zone)
+	keys := make([]string, 0, len(sel.Tags))
+	for k := range sel.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		addFilter("tag:"+k, sel.Tags[k])
+	}
+	resp, err := svc.DescribeSubnets(ipt)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Subnets, nil
+}
+
+// FindNewestImage - the newest available image matching an AMI filter, nil if nothing matches, the filter must have an owner
+func FindNewestImage(svc EC2API, ami AMIConfig) (*ec2.Image, error) {
+	if ami.Owner == "" {
+		return nil, fmt.Errorf("AMI %s: %s", ami, AMIOwnerRequired)
+	}
+	ipt := &ec2.DescribeImagesInput{
+		Owners: []*string{aws.String(ami.Owner)},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("state"),
+				Values: []*string{aws.String(ec2.ImageStateAvailable)},
+			},
+		},
+	}
+	if ami.Name != "" {
+		ipt.Filters = append(ipt.Filters, &ec2.Filter{Name: aws.String("name"), Values: []*string{aws.String(ami.Name)}})
+	}
+	if ami.Architecture != "" {
+		ipt.Filters = append(ipt.Filters, &ec2.Filter{Name: aws.String("architecture"), Values: []*string{aws.String(ami.Architecture)}})
+	}
+	resp, err := svc.DescribeImages(ipt)
+	if err != nil {
+		return nil, err
+	}
+	var newest *ec2.Image
+	for _, img := range resp.Images {
+		// creation dates are all the same ISO 8601 format, so they sort as strings
+		if newest == nil || aws.StringValue(img.CreationDate) > aws.StringValue(newest.CreationDate) {
+			newest = img
+		}
 	}
+	return newest, nil
+}
+
+// FindSecurityGroup - look up a security group by id (sg-...) in any vpc, or by name in the given vpc, nil if it doesn't exist
+func FindSecurityGroup(svc EC2API, vpcID string, nameOrID string) (*ec2.SecurityGroup, error) {
+	ipt := &ec2.DescribeSecurityGroupsInput{}
+	if strings.HasPrefix(nameOrID, "sg-") {
+		ipt.GroupIds = []*string{aws.String(nameOrID)}
+	} else {
+		ipt.Filters = []*ec2.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []*string{aws.String(nameOrID)},
+			},
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{aws.String(vpcID)},
+			},
+		}
+	}
+	resp, err := svc.DescribeSecurityGroups(ipt)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidGroup.NotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.SecurityGroups) == 0 {
+		return nil, nil
+	}
+	return resp.SecurityGroups[0], nil
+}
+
+// GetInstanceProfile - look up an instance profile by name or ARN, nil if it doesn't exist
+func GetInstanceProfile(svc IAMAPI, nameOrARN string) (*iam.InstanceProfile, error) {
+	name := nameOrARN
+	if strings.HasPrefix(nameOrARN, "arn:") {
+		name = nameOrARN[strings.LastIndex(nameOrARN, "/")+1:]
+	}
+	resp, err := svc.GetInstanceProfile(&iam.GetInstanceProfileInput{InstanceProfileName: aws.String(name)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if name != nameOrARN && aws.StringValue(resp.InstanceProfile.Arn) != nameOrARN {
+		return nil, nil
+	}
+	return resp.InstanceProfile, nil
+}
+
+// util - the instance's volumes as block device mappings, nil if it has none
+func createBlockDeviceMappings(inst EC2Instance) []*ec2.BlockDeviceMapping {
+	if len(inst.Volumes) == 0 {
+		return nil
+	}
+	mappings := make([]*ec2.BlockDeviceMapping, 0, len(inst.Volumes))
+	for _, vol := range inst.Volumes {
+		ebs := &ec2.EbsBlockDevice{DeleteOnTermination: vol.DeleteOnTermination}
+		if vol.Size > 0 {
+			ebs.VolumeSize = aws.Int64(vol.Size)
+		}
+		if vol.Type != "" {
+			ebs.VolumeType = aws.String(vol.Type)
+		}
+		if vol.IOPS > 0 {
+			ebs.Iops = aws.Int64(vol.IOPS)
+		}
+		if vol.Throughput > 0 {
+			ebs.Throughput = aws.Int64(vol.Throughput)
+		}
+		if vol.Encrypted {
+			ebs.Encrypted = aws.Bool(true)
+		}
+		if vol.KMSKeyID != "" {
+			ebs.KmsKeyId = aws.String(vol.KMSKeyID)
+		}
+		mappings = append(mappings, &ec2.BlockDeviceMapping{DeviceName: aws.String(vol.Device), Ebs: ebs})
+	}
+	return mappings
+}
+
+// util - the instance's placement, nil if it doesn't set any placement options
+func createPlacement(inst EC2Instance) *ec2.Placement {
+	if inst.Zone == "" && inst.PlacementGroup == "" && inst.Tenancy == "" && inst.Affinity == "" && inst.HostID == "" {
+		return nil
+	}
+	placement := &ec2.Placement{}
+	if inst.Zone != "" {
+		placement.AvailabilityZone = aws.String(inst.Zone)
+	}
+	if inst.PlacementGroup != "" {
+		placement.GroupName = aws.String(inst.PlacementGroup)
+	}
+	if inst.Tenancy != "" {
+		placement.Tenancy = aws.String(inst.Tenancy)
+	}
+	if inst.Affinity != "" {
+		placement.Affinity = aws.String(inst.Affinity)
+	}
+	if inst.HostID != "" {
+		placement.HostId = aws.String(inst.HostID)
+	}
+	return placement
+}
+
+// GetSubnet - look up a subnet by id, nil if it doesn't exist
+func GetSubnet(svc EC2API, subnetID string) (*ec2.Subnet, error) {
+	resp, err := svc.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(subnetID)}})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidSubnetID.NotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Subnets) == 0 {
+		return nil, nil
+	}
+	return resp.Subnets[0], nil
+}
+
+// GetImage - look up an image by id, nil if it doesn't exist
+func GetImage(svc EC2API, imageID string) (*ec2.Image, error) {
+	resp, err := svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(imageID)}})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidAMIID.NotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Images) == 0 {
+		return nil, nil
+	}
+	return resp.Images[0], nil
+}
+
+// GetKeyPair - look up a key pair by name, nil if it doesn't exist
+func GetKeyPair(svc EC2API, name string) (*ec2.KeyPairInfo, error) {
+	resp, err := svc.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{KeyNames: []*string{aws.String(name)}})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidKeyPair.NotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.KeyPairs) == 0 {
+		return nil, nil
+	}
+	return resp.KeyPairs[0], nil
+}
+
+// GetAddress - look up an elastic IP by allocation id, nil if it doesn't exist
+func GetAddress(svc EC2API, allocationID string) (*ec2.Address, error) {
+	resp, err := svc.DescribeAddresses(&ec2.DescribeAddressesInput{AllocationIds: []*string{aws.String(allocationID)}})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidAllocationID.NotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Addresses) == 0 {
+		return nil, nil
+	}
+	return resp.Addresses[0], nil
+}
+
+// GetHostedZone - look up a route53 hosted zone by id, nil if it doesn't exist
+func GetHostedZone(svc Route53API, zoneID string) (*route53.HostedZone, error) {
+	resp, err := svc.GetHostedZone(&route53.GetHostedZoneInput{Id: aws.String(zoneID)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == route53.ErrCodeNoSuchHostedZone {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.HostedZone, nil
+}
+
+// DryRunInstance - ask EC2 whether launching the instance would succeed without launching it, nil if it would, EC2's
+// error (e.g. UnauthorizedOperation) if not
+func DryRunInstance(svc EC2API, config RunConfig, inst EC2Instance) error {
+	ipt := createRunInstanceInput(config, inst)
+	ipt.DryRun = aws.Bool(true)
+	_, err := svc.RunInstances(ipt)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "DryRunOperation" {
+		return nil
+	}
+	return err
+}
+
+// util - the tags every terrafire instance (and its volumes and network interfaces) gets, terrafire's own (including provenance) plus the user's merged tags
+func createInstanceTags(config RunConfig, inst EC2Instance) []*ec2.Tag {
+	userTags := config.InstanceTags(inst)
+	keys := make([]string, 0, len(userTags))
+	for k := range userTags {
+		if !containsString(ReservedTags, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	tags := []*ec2.Tag{
+		{
+			Key:   aws.String(TagName),
+			Value: aws.String(inst.Name),
+		},
+		{
+			Key:   aws.String(TagLauncher),
+			Value: aws.String(LauncherTerrafire),
+		},
+		{
+			Key:   aws.String(TagGroup),
+			Value: aws.String(config.Group.Name),
+		},
+		{
+			Key:   aws.String(TagTier),
+			Value: aws.String(config.Tier.Name),
+		},
+		{
+			Key:   aws.String(TagVersion),
+			Value: aws.String(Version),
+		},
+	}
+	prov := config.Provenance
+	if !prov.LaunchedAt.IsZero() {
+		tags = append(tags, &ec2.Tag{Key: aws.String(TagLaunchedAt), Value: aws.String(prov.LaunchedAt.Format(time.RFC3339))})
+	}
+	if prov.LaunchedBy != "" {
+		tags = append(tags, &ec2.Tag{Key: aws.String(TagLaunchedBy), Value: aws.String(prov.LaunchedBy)})
+	}
+	if prov.ConfigHash != "" {
+		tags = append(tags, &ec2.Tag{Key: aws.String(TagConfigHash), Value: aws.String(prov.ConfigHash)})
+	}
+	for _, k := range keys {
+		tags = append(tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(userTags[k])})
+	}
+	return tags
 }
 
 // util - build a filter to check tags "Launcher=Terrafire" and "TerrafireGroup=group"
@@ -82,11 +541,11 @@ func CreateGroupInstanceFilter(group GroupConfig) *ec2.DescribeInstancesInput {
 	flt := &ec2.DescribeInstancesInput{
 		Filters: []*ec2.Filter{
 			{
-				Name:   aws.String("tag:Launcher"),
-				Values: []*string{aws.String("Terrafire")},
+				Name:   aws.String("tag:" + TagLauncher),
+				Values: []*string{aws.String(LauncherTerrafire)},
 			},
 			{
-				Name:   aws.String("tag:TerrafireGroup"),
+				Name:   aws.String("tag:" + TagGroup),
 				Values: []*string{aws.String(group.Name)},
 			},
 		},
@@ -94,6 +553,16 @@ func CreateGroupInstanceFilter(group GroupConfig) *ec2.DescribeInstancesInput {
 	return flt
 }
 
+// CreateTierInstanceFilter - the group filter narrowed down to a single tier by its "TerrafireTier" tag
+func CreateTierInstanceFilter(group GroupConfig, tier string) *ec2.DescribeInstancesInput {
+	flt := CreateGroupInstanceFilter(group)
+	flt.Filters = append(flt.Filters, &ec2.Filter{
+		Name:   aws.String("tag:" + TagTier),
+		Values: []*string{aws.String(tier)},
+	})
+	return flt
+}
+
 // CreateIDInstanceFilter - build a filter to get instances by id
 func CreateIDInstanceFilter(idMap map[string]EC2Instance) *ec2.DescribeInstancesInput {
 	var ids []string
@@ -130,68 +599,125 @@ func GetInstanceStateIcon(state string) string {
 	return res
 }
 
-// RunInstances - run all the instances in the whole group
-func RunInstances(svc *ec2.EC2, config RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) (map[string]EC2Instance, error) {
-	instanceMap := make(map[string]EC2Instance, 0)
+// LaunchResult - the outcome of launching a single instance
+type LaunchResult struct {
+	Instance   EC2Instance
+	InstanceID string
+	Err        error
+}
+
+// LaunchError - one or more instances in a tier failed to launch
+type LaunchError struct {
+	Failed []LaunchResult
+}
+
+func (le LaunchError) Error() string {
+	msgs := make([]string, 0, len(le.Failed))
+	for _, res := range le.Failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", res.Instance.Name, res.Err))
+	}
+	return fmt.Sprintf("%d instance(s) failed to launch: %s", len(le.Failed), strings.Join(msgs, "; "))
+}
+
+// RunInstances - launch (and tag) all the instances in the tier, config.Parallelism() at a time.  On error the instances
+// that did launch are still returned, the error is a LaunchError with the ones that didn't.
+func RunInstances(svc EC2API, config RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) (map[string]EC2Instance, error) {
+	// render all the user data up front, every worker reads the same instance data, an instance whose user data doesn't
+	// render isn't launched
+	jobs := make(chan int, len(config.Tier.Instances))
+	results := make([]LaunchResult, len(config.Tier.Instances))
 	for idx := range config.Tier.Instances {
-		// create the instance input and launch
 		inst := config.Tier.Instances[idx]
-		inst.UserData = createInstanceUserData(config, inst, instanceData)
-		ipt := createRunInstanceInput(inst)
-		logger.Printf("Launching: %v\n", inst.Name)
-		res, err := svc.RunInstances(ipt)
-		if err != nil {
-			return nil, err
+		var err error
+		inst.UserData, err = createInstanceUserData(config, inst, instanceData)
+		results[idx] = LaunchResult{Instance: inst, Err: err}
+		if err == nil {
+			jobs <- idx
 		}
+	}
+	close(jobs)
 
-		// keep the new details in the instance map
-		newInstanceID := res.Instances[0].InstanceId
-		instanceMap[*newInstanceID] = inst
+	// launch with a bounded pool of workers
+	var waiter sync.WaitGroup
+	for w := 0; w < config.Parallelism(); w++ {
+		waiter.Add(1)
+		go func() {
+			defer waiter.Done()
+			for idx := range jobs {
+				results[idx].InstanceID, results[idx].Err = launchInstance(svc, config, results[idx].Instance, logger)
+			}
+		}()
+	}
+	waiter.Wait()
 
-		// tag the newly launched instances
-		_, errtag := svc.CreateTags(&ec2.CreateTagsInput{
-			Resources: []*string{newInstanceID},
-			Tags: []*ec2.Tag{
-				{
-					Key:   aws.String("Name"),
-					Value: aws.String(inst.Name),
-				},
-				{
-					Key:   aws.String("Launcher"),
-					Value: aws.String("Terrafire"),
-				},
-				{
-					Key:   aws.String("TerrafireGroup"),
-					Value: aws.String(config.Group.Name),
-				},
-			},
-		})
-		if errtag != nil {
-			panic(fmt.Errorf("ERROR Could not create tags for instance: %s, error: %s", *newInstanceID, errtag))
+	// keep the new details in the instance map, collect any failures
+	instanceMap := make(map[string]EC2Instance, 0)
+	launchErr := LaunchError{}
+	for _, res := range results {
+		if res.InstanceID != "" {
+			instanceMap[res.InstanceID] = res.Instance
 		}
+		if res.Err != nil {
+			launchErr.Failed = append(launchErr.Failed, res)
+		}
+	}
+	if len(launchErr.Failed) > 0 {
+		return instanceMap, launchErr
 	}
 	return instanceMap, nil
 }
 
-// RunInstancesNoop - simulate a run
-func RunInstancesNoop(config RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) map[string]EC2Instance {
+// util - launch a single instance, it is tagged as part of the launch, spot launches can fall back to on-demand
+func launchInstance(svc EC2API, config RunConfig, inst EC2Instance, logger *log.Logger) (string, error) {
+	market, spot := config.InstanceMarket(inst)
+	ipt := createRunInstanceInput(config, inst)
+	logger.Printf("Launching: %v\n", inst.Name)
+	res, err := svc.RunInstances(ipt)
+	if err != nil && market == MarketSpot && spot.Fallback && spotCapacityError(err) {
+		logger.Printf("No spot capacity for %s (%s), falling back to on-demand\n", inst.Name, err)
+		ipt.InstanceMarketOptions = nil
+		res, err = svc.RunInstances(ipt)
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(res.Instances[0].InstanceId), nil
+}
+
+// RunInstancesNoop - simulate a run, an error if any instance's user data doesn't render
+func RunInstancesNoop(config RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) (map[string]EC2Instance, error) {
 	instanceMap := make(map[string]EC2Instance, 0)
 	for idx := range config.Tier.Instances {
 		inst := config.Tier.Instances[idx]
-		inst.UserData = createInstanceUserData(config, inst, instanceData)
+		var err error
+		if inst.UserData, err = createInstanceUserData(config, inst, instanceData); err != nil {
+			return instanceMap, fmt.Errorf("instance '%s' user data: %s", inst.Name, err)
+		}
 		logger.Printf("Launching (noop): %v\n", inst.Name)
+		if inst.AMI.IsFilter() {
+			logger.Printf("   ami: %s\n", inst.AMI)
+		}
+		if inst.Subnet.IsSelector() {
+			logger.Printf("   subnet: %s\n", inst.Subnet)
+		}
+		if market, spot := config.InstanceMarket(inst); market == MarketSpot {
+			logger.Printf("   market: spot, max price: %s, interruption: %s, fallback to on-demand: %t\n", spot.MaxPrice, spot.Interruption, spot.Fallback)
+		}
+		for _, vol := range inst.Volumes {
+			logger.Printf("   volume %s\n", vol)
+		}
 		newInstanceID := fmt.Sprintf("instance_%s_%d", config.Tier.Name, idx)
 		instanceMap[newInstanceID] = inst
 	}
-	return instanceMap
+	return instanceMap, nil
 }
 
 // GetInstances - get instance data
-func GetInstances(svc *ec2.EC2, flt *ec2.DescribeInstancesInput) map[string]*ec2.Instance {
+func GetInstances(svc EC2API, flt *ec2.DescribeInstancesInput) (map[string]*ec2.Instance, error) {
 	instanceData := make(map[string]*ec2.Instance, 0)
 	launched, err := svc.DescribeInstances(flt)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	for resIdx := range launched.Reservations {
 		res := launched.Reservations[resIdx]
@@ -200,7 +726,7 @@ func GetInstances(svc *ec2.EC2, flt *ec2.DescribeInstancesInput) map[string]*ec2
 			instanceData[*inst.InstanceId] = inst
 		}
 	}
-	return instanceData
+	return instanceData, nil
 }
 
 // GetInstancesNoop - generate fake instance data
@@ -214,8 +740,76 @@ func GetInstancesNoop(config RunConfig, instanceMap map[string]EC2Instance) map[
 	return instanceData
 }
 
+// TerminateInstances - terminate instances by id, cancelling their spot requests first so persistent ones don't relaunch them
+func TerminateInstances(svc EC2API, ids []string, logger *log.Logger) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	instances, err := GetInstances(svc, &ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)})
+	if err != nil {
+		return err
+	}
+	requests := make([]string, 0)
+	for _, id := range ids {
+		if inst, ok := instances[id]; ok && aws.StringValue(inst.SpotInstanceRequestId) != "" {
+			requests = append(requests, aws.StringValue(inst.SpotInstanceRequestId))
+		}
+	}
+	if len(requests) > 0 {
+		logger.Printf(" - Cancelling spot requests: %v\n", requests)
+		if _, err := svc.CancelSpotInstanceRequests(&ec2.CancelSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: aws.StringSlice(requests),
+		}); err != nil {
+			return err
+		}
+	}
+	logger.Printf(" - Terminating: %v\n", ids)
+	_, err = svc.TerminateInstances(&ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	})
+	return err
+}
+
+// WaitForInstanceState - poll until all the instances reach a state, logging each state change as it happens
+func WaitForInstanceState(svc EC2API, ids []string, state string, logger *log.Logger) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	flt := &ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)}
+	seen := make(map[string]string)
+	for attempt := 0; attempt < WaitAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(WaitInterval)
+		}
+		instances, err := GetInstances(svc, flt)
+		if err != nil {
+			return err
+		}
+		done := true
+		for _, id := range ids {
+			inst, ok := instances[id]
+			if !ok {
+				done = false
+				continue
+			}
+			current := aws.StringValue(inst.State.Name)
+			if seen[id] != current {
+				logger.Printf("   %s %s (%s) is %s\n", GetInstanceStateIcon(current), GetInstanceTag(TagName, *inst), id, current)
+				seen[id] = current
+			}
+			if current != state {
+				done = false
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+	return fmt.Errorf("gave up waiting for instances to be %s after %v: %v", state, time.Duration(WaitAttempts)*WaitInterval, ids)
+}
+
 // AssociateElasticIP - associate instances with any elastic IP addresses
-func AssociateElasticIP(svc *ec2.EC2, runConf RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) error {
+func AssociateElasticIP(svc EC2API, runConf RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) error {
 	for idx := range runConf.Tier.Instances {
 		inst := runConf.Tier.Instances[idx]
 		linst := instanceData[inst.Name]
@@ -233,13 +827,13 @@ func AssociateElasticIP(svc *ec2.EC2, runConf RunConfig, instanceData map[string
 	return nil
 }
 
-// UpdateRoute53 - updates the route53 "A" records for nodes in this tier
-func UpdateRoute53(svc *route53.Route53, runConf RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) error {
+// UpdateRoute53 - updates the route53 "A" records for nodes in this tier, returns the records written (even on error)
+func UpdateRoute53(svc Route53API, runConf RunConfig, instanceData map[string]EC2InstanceLive, logger *log.Logger) ([]PlanRecord, error) {
+	records := make([]PlanRecord, 0)
 	for idx := range runConf.Tier.Instances {
 		inst := runConf.Tier.Instances[idx]
-		if inst.Route53.ZoneID != "" && inst.Route53.Suffix != "" {
+		if fqdn := inst.Route53FQDN(); fqdn != "" {
 			linst := instanceData[inst.Name]
-			fqdn := inst.Name + "." + inst.Route53.Suffix
 			val := linst.PublicIpAddress
 			if inst.Route53.RecordType == "CNAME" {
 				val = linst.PublicDnsName
@@ -247,11 +841,60 @@ func UpdateRoute53(svc *route53.Route53, runConf RunConfig, instanceData map[str
 			r53params := createRoute53Params("UPSERT", inst.Route53.RecordType, inst.Route53.ZoneID, fqdn, val, inst.Route53.TTL)
 			resp, err := svc.ChangeResourceRecordSets(r53params)
 			if err != nil {
-				return err
+				return records, err
 			}
+			records = append(records, PlanRecord{Tier: runConf.Tier.Name, Instance: inst.Name, ZoneID: inst.Route53.ZoneID, RecordSet: r53params.ChangeBatch.Changes[0].ResourceRecordSet})
 			logger.Println(resp)
 		}
 	}
+	return records, nil
+}
+
+// GetRoute53Record - look up the record set for an instance's route53 name and type, nil if there isn't one
+func GetRoute53Record(svc Route53API, inst EC2Instance) (*route53.ResourceRecordSet, error) {
+	fqdn := inst.Route53FQDN()
+	if fqdn == "" {
+		return nil, nil
+	}
+	if inst.Route53.RecordType == "" {
+		return nil, fmt.Errorf("instance '%s' route53 config has no record type", inst.Name)
+	}
+	resp, err := svc.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(inst.Route53.ZoneID),
+		StartRecordName: aws.String(fqdn),
+		StartRecordType: aws.String(inst.Route53.RecordType),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rrs := range resp.ResourceRecordSets {
+		if strings.EqualFold(fqdnWithDot(aws.StringValue(rrs.Name)), fqdnWithDot(fqdn)) && aws.StringValue(rrs.Type) == inst.Route53.RecordType {
+			return rrs, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteRoute53Records - delete the route53 record sets found by a destroy plan
+func DeleteRoute53Records(svc Route53API, records []PlanRecord, logger *log.Logger) error {
+	for _, rec := range records {
+		logger.Printf(" - Deleting: %s (route53 %s record)\n", rec.Name(), aws.StringValue(rec.RecordSet.Type))
+		_, err := svc.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+			ChangeBatch: &route53.ChangeBatch{
+				Changes: []*route53.Change{
+					{
+						Action:            aws.String(route53.ChangeActionDelete),
+						ResourceRecordSet: rec.RecordSet,
+					},
+				},
+			},
+			HostedZoneId: aws.String(rec.ZoneID),
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
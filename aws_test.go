@@ -0,0 +1,305 @@
+package terrafire
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCustomEndpointsHaveARegion(t *testing.T) {
+	sesh := session.Must(session.NewSession())
+	r53 := CreateRoute53Service("eu-west-1", "http://localhost:4566", sesh)
+	if region, endpoint := aws.StringValue(r53.Config.Region), r53.Endpoint; region != "eu-west-1" || endpoint != "http://localhost:4566" {
+		t.Errorf("route53 region %q, endpoint %q, want eu-west-1 and the custom endpoint", region, endpoint)
+	}
+	iamSvc := CreateIAMService("eu-west-1", "http://localhost:4566", sesh)
+	if region, endpoint := aws.StringValue(iamSvc.Config.Region), iamSvc.Endpoint; region != "eu-west-1" || endpoint != "http://localhost:4566" {
+		t.Errorf("iam region %q, endpoint %q, want eu-west-1 and the custom endpoint", region, endpoint)
+	}
+}
+
+func TestWaitForInstanceState(t *testing.T) {
+	defer func(interval time.Duration, attempts int) { WaitInterval, WaitAttempts = interval, attempts }(WaitInterval, WaitAttempts)
+	WaitInterval, WaitAttempts = time.Millisecond, 3
+	logger := log.New(ioutil.Discard, "", 0)
+
+	svc := NewFakeEC2(nil)
+	res, err := svc.RunInstances(&ec2.RunInstancesInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{aws.StringValue(res.Instances[0].InstanceId)}
+	if err := WaitForInstanceState(svc, ids, ec2.InstanceStateNameRunning, logger); err != nil {
+		t.Errorf("waiting for a running instance to run: %s", err)
+	}
+	if err := TerminateInstances(svc, ids, logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForInstanceState(svc, ids, ec2.InstanceStateNameTerminated, logger); err != nil {
+		t.Errorf("waiting for a terminated instance to terminate: %s", err)
+	}
+	if err := WaitForInstanceState(svc, ids, ec2.InstanceStateNameRunning, logger); err == nil {
+		t.Error("waiting for a terminated instance to run didn't give up")
+	}
+	if err := WaitForInstanceState(svc, nil, ec2.InstanceStateNameRunning, logger); err != nil {
+		t.Errorf("waiting for no instances: %s", err)
+	}
+}
+
+// util - a template directory holding the given templates, removed when the test ends
+func writeTestTemplates(t *testing.T, templates map[string]string) string {
+	dir, err := ioutil.TempDir("", "terrafire-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, text := range templates {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// util - counts how many RunInstances calls are in flight at once, and fails the launches of one instance type
+type concurrentEC2 struct {
+	EC2API
+	fail     string
+	mu       sync.Mutex
+	inFlight int
+	most     int
+}
+
+func (c *concurrentEC2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.most {
+		c.most = c.inFlight
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if aws.StringValue(input.InstanceType) == c.fail {
+		return nil, errors.New("no capacity")
+	}
+	return c.EC2API.RunInstances(input)
+}
+
+func TestRunInstancesParallelism(t *testing.T) {
+	dir := writeTestTemplates(t, map[string]string{"boot.tmpl": "#!/bin/sh\n"})
+	tier := EC2InstanceTier{Name: "web", Parallelism: 2}
+	for _, name := range []string{"web1", "web2", "web3", "web4", "web5"} {
+		tier.Instances = append(tier.Instances, EC2Instance{Name: name, Type: "t3.small", Bootstrap: BootTemplates{Content: "boot.tmpl"}})
+	}
+	tier.Instances[2].Type = "x1.32xlarge"
+	svc := &concurrentEC2{EC2API: NewFakeEC2(nil), fail: "x1.32xlarge"}
+	config := RunConfig{BaseConfig: BaseConfig{TemplatePath: dir, Parallelism: 4}, Group: GroupConfig{Name: "test"}, Tier: tier}
+
+	launched, err := RunInstances(svc, config, map[string]EC2InstanceLive{}, log.New(ioutil.Discard, "", 0))
+	if svc.most != 2 {
+		t.Errorf("at most %d launches at once, want the tier's 2", svc.most)
+	}
+	launchErr, ok := err.(LaunchError)
+	if !ok || len(launchErr.Failed) != 1 || launchErr.Failed[0].Instance.Name != "web3" {
+		t.Fatalf("error = %v, want only web3 failed", err)
+	}
+	if len(launched) != 4 {
+		t.Errorf("launched %v, want the other four", launched)
+	}
+}
+
+// util - tags as a map, for comparing
+func tagMap(tags []*ec2.Tag) map[string]string {
+	res := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		res[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return res
+}
+
+func TestCreateRunInstanceInputTags(t *testing.T) {
+	config := RunConfig{Group: GroupConfig{Name: "test"}, Tier: EC2InstanceTier{Name: "web"}}
+	input := createRunInstanceInput(config, EC2Instance{Name: "web1"})
+
+	tagged := make(map[string]bool)
+	for _, spec := range input.TagSpecifications {
+		resType := aws.StringValue(spec.ResourceType)
+		tagged[resType] = true
+		tags := tagMap(spec.Tags)
+		if tags[TagName] != "web1" || tags[TagLauncher] != LauncherTerrafire || tags[TagGroup] != "test" {
+			t.Errorf("%s tags = %v, want the name, launcher and group", resType, tags)
+		}
+	}
+	for _, resType := range []string{ec2.ResourceTypeInstance, ec2.ResourceTypeVolume, ec2.ResourceTypeNetworkInterface} {
+		if !tagged[resType] {
+			t.Errorf("no tags for the %s", resType)
+		}
+	}
+}
+
+func TestCreateInstanceTags(t *testing.T) {
+	config := RunConfig{
+		Group: GroupConfig{Name: "test", Tags: map[string]string{"team": "ops", "env": "dev"}},
+		Tier:  EC2InstanceTier{Name: "web", Tags: map[string]string{"env": "prod", TagGroup: "other"}},
+	}
+	tags := tagMap(createInstanceTags(config, EC2Instance{Name: "web1", Tags: map[string]string{"role": "web"}}))
+
+	want := map[string]string{"team": "ops", "env": "prod", "role": "web", TagGroup: "test", TagName: "web1"}
+	for key, value := range want {
+		if tags[key] != value {
+			t.Errorf("tag %s = %q, want %q", key, tags[key], value)
+		}
+	}
+}
+
+func TestProvenanceTags(t *testing.T) {
+	prov, err := GetProvenance(NewFakeSTS(nil), "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := RunConfig{Group: GroupConfig{Name: "test"}, Tier: EC2InstanceTier{Name: "web"}, Provenance: prov}
+	tags := tagMap(createInstanceTags(config, EC2Instance{Name: "web1"}))
+
+	want := map[string]string{
+		TagTier:       "web",
+		TagVersion:    Version,
+		TagLaunchedBy: FakeCallerARN,
+		TagLaunchedAt: prov.LaunchedAt.Format(time.RFC3339),
+		TagConfigHash: "abc123",
+	}
+	for key, value := range want {
+		if tags[key] != value {
+			t.Errorf("tag %s = %q, want %q", key, tags[key], value)
+		}
+	}
+	if tags := tagMap(createInstanceTags(RunConfig{Tier: config.Tier}, EC2Instance{Name: "web1"})); tags[TagLaunchedAt] != "" || tags[TagConfigHash] != "" {
+		t.Errorf("tags without provenance = %v, want no launch details", tags)
+	}
+}
+
+func TestCreatePlacement(t *testing.T) {
+	if placement := createPlacement(EC2Instance{Name: "web1"}); placement != nil {
+		t.Errorf("placement without options = %v, want nil", placement)
+	}
+	placement := createPlacement(EC2Instance{Name: "web1", Zone: "us-east-1a", PlacementGroup: "pg", Tenancy: ec2.TenancyDedicated})
+	if aws.StringValue(placement.AvailabilityZone) != "us-east-1a" || aws.StringValue(placement.GroupName) != "pg" || aws.StringValue(placement.Tenancy) != ec2.TenancyDedicated || placement.HostId != nil {
+		t.Errorf("placement = %v, want the zone, group and tenancy", placement)
+	}
+}
+
+func TestCreateBlockDeviceMappings(t *testing.T) {
+	if mappings := createBlockDeviceMappings(EC2Instance{Name: "db1"}); mappings != nil {
+		t.Errorf("mappings without volumes = %v, want nil", mappings)
+	}
+	inst := EC2Instance{Name: "db1", Volumes: []EBSVolume{
+		{Device: "/dev/xvdb", Size: 100, Type: ec2.VolumeTypeGp3, Throughput: 250, Encrypted: true, KMSKeyID: "key", DeleteOnTermination: aws.Bool(false)},
+		{Device: "/dev/xvdc", Size: 20},
+	}}
+	mappings := createBlockDeviceMappings(inst)
+	if len(mappings) != 2 {
+		t.Fatalf("mappings = %v, want one per volume", mappings)
+	}
+	ebs := mappings[0].Ebs
+	if aws.StringValue(mappings[0].DeviceName) != "/dev/xvdb" || aws.Int64Value(ebs.VolumeSize) != 100 || aws.StringValue(ebs.VolumeType) != ec2.VolumeTypeGp3 ||
+		aws.Int64Value(ebs.Throughput) != 250 || !aws.BoolValue(ebs.Encrypted) || aws.StringValue(ebs.KmsKeyId) != "key" || ebs.DeleteOnTermination == nil || *ebs.DeleteOnTermination {
+		t.Errorf("first mapping = %v, want every setting carried over", mappings[0])
+	}
+	if ebs := mappings[1].Ebs; ebs.VolumeType != nil || ebs.Iops != nil || ebs.Encrypted != nil || ebs.DeleteOnTermination != nil {
+		t.Errorf("second mapping = %v, want unset settings left to EC2's defaults", mappings[1])
+	}
+}
+
+func TestCreateMarketOptions(t *testing.T) {
+	inst := EC2Instance{Name: "web1"}
+	if opts := createMarketOptions(RunConfig{}, inst); opts != nil {
+		t.Errorf("on-demand market options = %v, want nil", opts)
+	}
+	tier := EC2InstanceTier{Name: "web", Market: MarketSpot, Spot: SpotConfig{MaxPrice: "0.05"}}
+	opts := createMarketOptions(RunConfig{Tier: tier}, inst)
+	if opts == nil || aws.StringValue(opts.SpotOptions.SpotInstanceType) != ec2.SpotInstanceTypeOneTime || aws.StringValue(opts.SpotOptions.MaxPrice) != "0.05" {
+		t.Errorf("spot market options = %v, want a one-time request at 0.05", opts)
+	}
+	tier.Spot.Interruption = ec2.InstanceInterruptionBehaviorStop
+	if opts := createMarketOptions(RunConfig{Tier: tier}, inst); aws.StringValue(opts.SpotOptions.SpotInstanceType) != ec2.SpotInstanceTypePersistent {
+		t.Errorf("stop on interruption market options = %v, want a persistent request", opts)
+	}
+	inst.Market = MarketOnDemand
+	if opts := createMarketOptions(RunConfig{Tier: tier}, inst); opts != nil {
+		t.Errorf("market options for an on-demand instance in a spot tier = %v, want nil", opts)
+	}
+}
+
+func TestLaunchInstanceSpotFallback(t *testing.T) {
+	state := NewFakeState()
+	state.SetSpotCapacity(false)
+	svc := NewFakeEC2(state)
+	logger := log.New(ioutil.Discard, "", 0)
+	tier := EC2InstanceTier{Name: "web", Market: MarketSpot}
+	inst := EC2Instance{Name: "web1"}
+
+	if _, err := launchInstance(svc, RunConfig{Tier: tier}, inst, logger); err == nil {
+		t.Error("a spot launch without capacity or fallback succeeded")
+	}
+	tier.Spot.Fallback = true
+	id, err := launchInstance(svc, RunConfig{Tier: tier}, inst, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifecycle := state.findInstance(id).InstanceLifecycle; lifecycle != nil {
+		t.Errorf("fallback instance lifecycle = %s, want on-demand", aws.StringValue(lifecycle))
+	}
+}
+
+func TestTerminateInstancesCancelsSpotRequests(t *testing.T) {
+	state := NewFakeState()
+	svc := NewFakeEC2(state)
+	logger := log.New(ioutil.Discard, "", 0)
+	tier := EC2InstanceTier{Name: "web", Market: MarketSpot, Spot: SpotConfig{Interruption: ec2.InstanceInterruptionBehaviorStop}}
+	id, err := launchInstance(svc, RunConfig{Tier: tier}, EC2Instance{Name: "web1"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TerminateInstances(svc, []string{id}, logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Spot) != 1 || aws.StringValue(state.Spot[0].State) != ec2.SpotInstanceStateCancelled {
+		t.Errorf("spot requests = %v, want the persistent request cancelled", state.Spot)
+	}
+}
+
+func TestFindNewestImage(t *testing.T) {
+	state := NewFakeState()
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	state.AddImage("ami-old", "self", "base-1", "x86_64", day(1))
+	state.AddImage("ami-new", "self", "base-2", "x86_64", day(2))
+	state.AddImage("ami-arm", "self", "base-3", "arm64", day(3))
+	state.AddImage("ami-theirs", "other", "base-4", "x86_64", day(4))
+	svc := NewFakeEC2(state)
+
+	img, err := FindNewestImage(svc, AMIConfig{Owner: "self", Name: "base-*", Architecture: "x86_64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := aws.StringValue(img.ImageId); id != "ami-new" {
+		t.Errorf("newest image = %s, want ami-new", id)
+	}
+	if img, err := FindNewestImage(svc, AMIConfig{Owner: "self", Name: "nope-*"}); err != nil || img != nil {
+		t.Errorf("image for a name nothing matches = %v (%v), want none", img, err)
+	}
+	if _, err := FindNewestImage(svc, AMIConfig{Name: "base-*"}); err == nil {
+		t.Error("found an image without an owner")
+	}
+}
@@ -6,12 +6,24 @@ import (
 
 func init() {
 	RootCmd.AddCommand(groupsCmd)
+	RootCmd.AddCommand(validateCmd)
+	RootCmd.AddCommand(schemaCmd)
 	RootCmd.AddCommand(planCmd)
 	RootCmd.AddCommand(applyCmd)
 	RootCmd.AddCommand(destroyCmd)
 	RootCmd.AddCommand(infoCmd)
 	RootCmd.AddCommand(hostsCmd)
 	RootCmd.AddCommand(postCmd)
+	RootCmd.AddCommand(seedCmd)
+
+	planCmd.Flags().StringVar(&planOut, "out", "", "Save the plan to this file, 'apply --plan' will run exactly that plan.")
+	planCmd.Flags().BoolVar(&resume, "resume", false, "Plan to resume an interrupted apply, already running instances are kept instead of being errors.")
+	applyCmd.Flags().StringVar(&planIn, "plan", "", "Apply a plan saved with 'plan --out', refuses to run if the config or live instances changed since.")
+	applyCmd.Flags().BoolVar(&resume, "resume", false, "Resume an interrupted apply, only the missing instances are launched.")
+	applyCmd.Flags().BoolVar(&rollbackOnFailure, "rollback-on-failure", false, "If the apply fails, terminate the instances and delete the route53 records it created.")
+	destroyCmd.Flags().StringVar(&destroyTier, "tier", "", "Only destroy the instances in this tier.")
+	destroyCmd.Flags().StringSliceVar(&destroyInstances, "instance", nil, "Only destroy the named instance(s), may be repeated.")
+	infoCmd.Flags().StringVar(&infoTier, "tier", "", "Only show the live instances tagged with this tier.")
 }
 
 // sub-commands
@@ -35,6 +47,20 @@ var groupsCmd = &cobra.Command{
 	RunE:  runGroups,
 }
 
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config and templates without talking to AWS.",
+	Long:  `This will check the config and user data templates of a group, or of every group when none is given.`,
+	RunE:  runValidate,
+}
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Show the JSON schema of the config file.",
+	Long:  `This will print a JSON schema of the config file, point your editor at it to have the config checked as you type.`,
+	RunE:  runSchema,
+}
+
 var planCmd = &cobra.Command{
 	Use:   "plan",
 	Short: "Show the plan for a group.",
@@ -76,3 +102,10 @@ var postCmd = &cobra.Command{
 	Long:  `This will run any post launch commands that are configured for a group (group name required).`,
 	RunE:  runPost,
 }
+
+var seedCmd = &cobra.Command{
+	Use:   "seed",
+	Short: "Add the resources a group refers to to the simulated backend.",
+	Long:  `This will add the resources a group refers to, such as elastic IPs, to the simulated backend's state, only missing ones are added (group name required).`,
+	RunE:  runSeed,
+}
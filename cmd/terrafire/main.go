@@ -9,37 +9,53 @@ import (
 	"os"
 	"strings"
 
-	"errors"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/bschwinn/terrafire"
 	"github.com/spf13/cobra"
-	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var debug bool
 var selectedGroup string
+var planOut string
+var planIn string
+var rollbackOnFailure bool
+var resume bool
+var destroyTier string
+var destroyInstances []string
+var infoTier string
 var infoLog *log.Logger
 var debugLog *log.Logger
 var errorLog *log.Logger
 
 const destroyOk = "YES"
 
+const backendAWS = "aws"
+const backendSim = "sim"
+
 func init() {
-	flag.BoolVarP(&debug, "debug", "d", false, "debugging flag, will dump viper/cobra data")
-	flag.StringVarP(&selectedGroup, "group", "g", "", "Group name, required fall all commands except default (groups).")
+	RootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "debugging flag, will dump viper/cobra data")
+	RootCmd.PersistentFlags().StringVarP(&selectedGroup, "group", "g", "", "Group name, required fall all commands except default (groups).")
+	RootCmd.PersistentFlags().String("backend", backendAWS, "Backend to run against, 'aws' or 'sim' for a local file-backed simulation.")
+	RootCmd.PersistentFlags().String("simstate", "terrafire-sim.json", "State file used by the 'sim' backend.")
+	cobra.OnInitialize(loadConfig)
 }
 
 // config defaults and merged global instance, structs in config.go
 var ourConfig terrafire.BaseConfig
 
-// main routine - kick off one of the sub-commands
+// main routine - kick off one of the sub-commands, cobra parses the flags and reports any it doesn't know
 func main() {
+	if err := RootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 
-	// parse all flags
-	flag.Parse()
+	os.Exit(0)
+}
+
+// util - load the configuration, run by cobra once the flags are parsed
+func loadConfig() {
 
 	// parse configuration
 	viper.SetConfigName("config") // name of config file (without extension)
@@ -49,8 +65,21 @@ func main() {
 	if err != nil {
 		panic(fmt.Errorf("fatal error config file: %s", err))
 	}
-	viper.BindPFlags(flag.CommandLine)
-	err = viper.Unmarshal(&ourConfig)
+	// viper would silently drop misspelled keys and mangle mistyped values, catch them with their line numbers first
+	configErrs, err := terrafire.CheckConfigFile(viper.ConfigFileUsed())
+	if err != nil {
+		fmt.Printf("fatal error checking config file: %s\n", err)
+		os.Exit(1)
+	}
+	if len(configErrs) > 0 {
+		for _, ce := range configErrs {
+			fmt.Println(ce)
+		}
+		fmt.Printf("fatal error config file: %d problem(s) found\n", len(configErrs))
+		os.Exit(1)
+	}
+	viper.BindPFlags(RootCmd.PersistentFlags())
+	err = viper.UnmarshalExact(&ourConfig, viper.DecodeHook(terrafire.ConfigDecodeHook()))
 	if err != nil {
 		fmt.Printf("fatal error unmarshalling config file: %s", err)
 		os.Exit(1)
@@ -69,13 +98,6 @@ func main() {
 	if ourConfig.Debug {
 		debugConfig()
 	}
-
-	// execution
-	if err := RootCmd.Execute(); err != nil {
-		errorLog.Fatal(err)
-	}
-
-	os.Exit(0)
 }
 
 // sub-command - show all the defined groups
@@ -87,6 +109,50 @@ func runGroups(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// sub-command - print the JSON schema of the config file
+func runSchema(cmd *cobra.Command, args []string) error {
+	schema, err := terrafire.ConfigSchema()
+	if err != nil {
+		errorLog.Fatalf("could not create the config schema: %s", err)
+	}
+	fmt.Println(string(schema))
+	return nil
+}
+
+// sub-command - check the selected group (or all of them) offline, fails if anything is wrong
+func runValidate(cmd *cobra.Command, args []string) error {
+	groups := ourConfig.Groups
+	if ourConfig.Group != "" {
+		groups = nil
+		for _, grp := range ourConfig.Groups {
+			if grp.Name == ourConfig.Group {
+				groups = append(groups, grp)
+			}
+		}
+		if len(groups) == 0 {
+			errorLog.Fatalf("terrafire group '%s' not found, run the 'groups' command to see all groups", ourConfig.Group)
+		}
+	}
+
+	problems := 0
+	for _, grp := range groups {
+		errs := terrafire.ValidateGroup(ourConfig, grp)
+		if len(errs) == 0 {
+			infoLog.Printf("Group: %s - OK", grp.Name)
+			continue
+		}
+		infoLog.Printf("Group: %s", grp.Name)
+		for _, verr := range errs {
+			infoLog.Printf(" - %s", verr)
+		}
+		problems += len(errs)
+	}
+	if problems > 0 {
+		errorLog.Fatalf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
 // sub-command - show all the defined hosts in a group
 func runHosts(cmd *cobra.Command, args []string) error {
 	group, err := getGroup()
@@ -105,6 +171,34 @@ func runHosts(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// sub-command - add the resources a group refers to to the simulated backend's state, so it can be planned and applied
+func runSeed(cmd *cobra.Command, args []string) error {
+	group, err := getGroup()
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	if ourConfig.Backend != backendSim {
+		errorLog.Fatalf("seed only works with the simulated backend, run it with --backend %s", backendSim)
+	}
+	state, err := terrafire.OpenSimState(ourConfig.SimState)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	added, err := state.SeedGroup(group)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	if len(added) == 0 {
+		infoLog.Printf("Nothing to add, %s already has everything group %s refers to", ourConfig.SimState, group.Name)
+		return nil
+	}
+	infoLog.Printf("Added to %s:", ourConfig.SimState)
+	for _, res := range added {
+		infoLog.Println(" - ", res)
+	}
+	return nil
+}
+
 // sub-command - show instance info for live instances in the group
 func runInfo(cmd *cobra.Command, args []string) error {
 	group, err := getGroup()
@@ -114,21 +208,40 @@ func runInfo(cmd *cobra.Command, args []string) error {
 
 	// get existing instances in group
 	infoLog.Println("Live resourcces in group:")
-	sesh := terrafire.CreateAWSSession()
-	ec2 := terrafire.CreateEC2Service(group.Region, sesh)
-
-	instances, err := terrafire.GetGroupInstances(group, ec2)
+	svcs, err := createServices(group)
 	if err != nil {
 		errorLog.Fatal(err)
 	}
-	for i := range instances {
-		ec2Inst := instances[i]
-		infoLog.Printf(" - %s (ec2 instance) - id: %s, state: %s", terrafire.GetInstanceTag("Name", ec2Inst), aws.StringValue(ec2Inst.InstanceId), terrafire.GetInstanceStateIcon(aws.StringValue(ec2Inst.State.Name)))
+
+	var instances []ec2.Instance
+	if infoTier != "" {
+		instances, err = terrafire.GetTierInstances(group, infoTier, svcs.EC2)
+	} else {
+		instances, err = terrafire.GetGroupInstances(group, svcs.EC2)
+	}
+	if err != nil {
+		errorLog.Fatal(err)
 	}
+	showInstancesByTier(group, terrafire.LiveInstances(group, instances))
 
 	return nil
 }
 
+// util - show live instances grouped by their tier
+func showInstancesByTier(group terrafire.GroupConfig, instances []terrafire.LiveInstance) {
+	tiers, byTier := terrafire.GroupInstancesByTier(group, instances)
+	for _, tier := range tiers {
+		if tier == "" {
+			infoLog.Println("No tier:")
+		} else {
+			infoLog.Printf("Tier: %s", tier)
+		}
+		for _, li := range byTier[tier] {
+			infoLog.Printf(" - %s (ec2 instance) - id: %s, state: %s", li.Name, li.InstanceID, terrafire.GetInstanceStateIcon(li.State))
+		}
+	}
+}
+
 // sub-command - show the plan for a group
 func runPlan(cmd *cobra.Command, args []string) error {
 	group, err := getGroup()
@@ -137,15 +250,23 @@ func runPlan(cmd *cobra.Command, args []string) error {
 	}
 
 	// create the plan
-	sesh := terrafire.CreateAWSSession()
-	svc := terrafire.CreateEC2Service(group.Region, sesh)
-	plan, planerr := createPlan(group, svc)
+	svcs, err := createServices(group)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	plan, planerr := terrafire.CreatePlan(ourConfig, group, svcs, terrafire.PlanOptions{Resume: resume})
 	if planerr != nil {
 		errorLog.Fatal(planerr)
 	}
 
+	// show what is already live, by the tier it was launched into
+	if len(plan.Snapshot) > 0 {
+		infoLog.Println("Live resources in group:")
+		showInstancesByTier(group, plan.Snapshot)
+	}
+
 	// show any errors else show the plan (what would be done)
-	if len(plan.Errors) > 0 {
+	if !plan.OK() {
 		infoLog.Println("Error(s) in plan")
 		for errIdx := range plan.Errors {
 			infoLog.Println(plan.Errors[errIdx])
@@ -157,8 +278,15 @@ func runPlan(cmd *cobra.Command, args []string) error {
 		allInstanceData := make(map[string]terrafire.EC2InstanceLive, 0)
 		for i := range plan.Group.Tiers {
 			tier := plan.Group.Tiers[i]
-			trc := terrafire.RunConfig{BaseConfig: ourConfig, Group: group, Tier: tier}
-			instanceMap := terrafire.RunInstancesNoop(trc, allInstanceData, infoLog)
+			trc := terrafire.RunConfig{BaseConfig: ourConfig, Group: group, Tier: plan.TierToLaunch(tier)}
+			instanceMap, runerr := terrafire.RunInstancesNoop(trc, allInstanceData, infoLog)
+			if runerr != nil {
+				errorLog.Fatal(runerr)
+			}
+			for _, pi := range plan.TierExisting(tier.Name) {
+				infoLog.Printf("Resuming (noop): %s (%s)\n", pi.Name, pi.InstanceID)
+				instanceMap[pi.InstanceID] = *tier.GetInstance(pi.Name)
+			}
 
 			// record instance details for reference in subsequent tiers
 			instanceMapLive := terrafire.GetInstancesNoop(trc, instanceMap)
@@ -178,6 +306,18 @@ func runPlan(cmd *cobra.Command, args []string) error {
 			errorLog.Fatal(posterr)
 		}
 
+		// save the plan so apply can run exactly this
+		if planOut != "" {
+			plan.UserData, err = terrafire.UserDataHashes(ourConfig, group)
+			if err != nil {
+				errorLog.Fatal(err)
+			}
+			saveerr := terrafire.SavePlan(planOut, plan)
+			if saveerr != nil {
+				errorLog.Fatal(saveerr)
+			}
+			infoLog.Printf("Plan saved to %s, run it with: apply --plan %s", planOut, planOut)
+		}
 	}
 	return nil
 }
@@ -190,16 +330,49 @@ func runApply(cmd *cobra.Command, args []string) error {
 	}
 
 	// create the plan
-	sesh := terrafire.CreateAWSSession()
-	svc := terrafire.CreateEC2Service(group.Region, sesh)
-	r53 := terrafire.CreateRoute53Service(sesh)
-	plan, planerr := createPlan(group, svc)
+	svcs, err := createServices(group)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	svc := svcs.EC2
+	r53 := svcs.Route53
+
+	// a saved plan is checked against a fresh one made the same way, with or without resume
+	opts := terrafire.PlanOptions{Resume: resume}
+	var saved terrafire.Plan
+	if planIn != "" {
+		var loaderr error
+		saved, loaderr = terrafire.LoadPlan(planIn)
+		if loaderr != nil {
+			errorLog.Fatal(loaderr)
+		}
+		if cmd.Flags().Changed("resume") && resume != saved.Resume {
+			errorLog.Fatalf("plan %s was saved with --resume=%t, re-run plan with --resume=%t", planIn, saved.Resume, resume)
+		}
+		opts.Resume = saved.Resume
+	}
+	plan, planerr := terrafire.CreatePlan(ourConfig, group, svcs, opts)
 	if planerr != nil {
 		errorLog.Fatal(planerr)
 	}
 
+	// a saved plan is only run if nothing has changed since it was written
+	if planIn != "" {
+		plan.UserData, err = terrafire.UserDataHashes(ourConfig, group)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		if verr := saved.VerifyAgainst(plan); verr != nil {
+			errorLog.Fatal(verr)
+		}
+		// errors are only as good as the latest run, keep the fresh plan's
+		saved.Errors = plan.Errors
+		plan = saved
+		infoLog.Printf("Applying saved plan: %s", planIn)
+	}
+
 	// show any errors else create the earth
-	if len(plan.Errors) > 0 {
+	if !plan.OK() {
 		infoLog.Println("Error(s) in plan")
 		for errIdx := range plan.Errors {
 			infoLog.Println(plan.Errors[errIdx])
@@ -208,41 +381,68 @@ func runApply(cmd *cobra.Command, args []string) error {
 
 		infoLog.Println("Plan looks OK, running....")
 
+		// everything launched is tagged with who launched it, when and from which config
+		prov, proverr := terrafire.GetProvenance(svcs.STS, plan.ConfigHash)
+		if proverr != nil {
+			errorLog.Fatal(proverr)
+		}
+		debugLog.Printf("Launching as %s", prov.LaunchedBy)
+
 		allInstanceData := make(map[string]terrafire.EC2InstanceLive, 0)
+		launched := make([]string, 0)
+		created := make([]terrafire.PlanRecord, 0)
 		for i := range plan.Group.Tiers {
 			// run the instances in this tier
 			tier := plan.Group.Tiers[i]
-			trc := terrafire.RunConfig{BaseConfig: ourConfig, Group: group, Tier: tier}
+			trc := terrafire.RunConfig{BaseConfig: ourConfig, Group: plan.Group, Tier: plan.TierToLaunch(tier), Provenance: prov}
 			instanceMap, err := terrafire.RunInstances(svc, trc, allInstanceData, infoLog)
+			for id := range instanceMap {
+				launched = append(launched, id)
+			}
 			if err != nil {
-				errorLog.Fatal(err)
+				failApply(svcs, launched, created, err)
 			}
 
+			// instances from an earlier, interrupted apply are reloaded along with the new ones
+			for _, pi := range plan.TierExisting(tier.Name) {
+				infoLog.Printf("Resuming: %s (%s)\n", pi.Name, pi.InstanceID)
+				instanceMap[pi.InstanceID] = *tier.GetInstance(pi.Name)
+			}
+			trc.Tier = tier
+
 			// wait for instances to launch
 			infoLog.Println(" - Waiting for instances to launch:", instanceMap)
 			flt := terrafire.CreateIDInstanceFilter(instanceMap)
 			err2 := svc.WaitUntilInstanceRunning(flt)
 			if err2 != nil {
-				errorLog.Fatal(err2)
+				failApply(svcs, launched, created, err2)
 			}
 			infoLog.Println(" - Instances have launched, looking up instance info....")
 
 			// record instance details for reference in subsequent tiers
-			instanceMapLive := terrafire.GetInstances(svc, flt)
+			instanceMapLive, lerr := terrafire.GetInstances(svc, flt)
+			if lerr != nil {
+				failApply(svcs, launched, created, lerr)
+			}
 
 			cerr := combineInstanceData(tier, instanceMap, instanceMapLive, allInstanceData)
 			if cerr != nil {
-				errorLog.Fatal(cerr)
+				failApply(svcs, launched, created, cerr)
 			}
 
 			elasticerr := terrafire.AssociateElasticIP(svc, trc, allInstanceData, infoLog)
 			if elasticerr != nil {
-				errorLog.Fatal(elasticerr)
+				failApply(svcs, launched, created, elasticerr)
 			}
 
-			r53err := terrafire.UpdateRoute53(r53, trc, allInstanceData, infoLog)
+			records, r53err := terrafire.UpdateRoute53(r53, trc, allInstanceData, infoLog)
+			for _, rec := range records {
+				if launchedNow(launched, allInstanceData[rec.Instance]) {
+					created = append(created, rec)
+				}
+			}
 			if r53err != nil {
-				errorLog.Fatal(r53err)
+				failApply(svcs, launched, created, r53err)
 			}
 
 			if ourConfig.Debug {
@@ -251,9 +451,19 @@ func runApply(cmd *cobra.Command, args []string) error {
 			}
 		}
 
+		// summary of what is running, and in which market
+		infoLog.Println("Apply summary:")
+		for _, tier := range plan.Group.Tiers {
+			for _, inst := range tier.Instances {
+				if live, ok := allInstanceData[inst.Name]; ok {
+					infoLog.Printf(" - %s (%s, tier: %s, market: %s)\n", inst.Name, live.InstanceID, tier.Name, live.Market)
+				}
+			}
+		}
+
 		// wait for instances to come up and then run the post launch scripts
-		svc.WaitUntilInstanceRunning(terrafire.CreateGroupInstanceFilter(group))
-		posterr := terrafire.PostProcessInstances(group, infoLog)
+		svc.WaitUntilInstanceRunning(terrafire.CreateGroupInstanceFilter(plan.Group))
+		posterr := postProcess(plan.Group)
 		if posterr != nil {
 			errorLog.Fatal(posterr)
 		}
@@ -268,7 +478,7 @@ func runPost(cmd *cobra.Command, args []string) error {
 		errorLog.Fatal(err)
 	}
 
-	posterr := terrafire.PostProcessInstances(group, infoLog)
+	posterr := postProcess(group)
 	if posterr != nil {
 		errorLog.Fatal(posterr)
 	}
@@ -284,44 +494,65 @@ func runDestroy(cmd *cobra.Command, args []string) error {
 	}
 
 	// create the plan
-	sesh := terrafire.CreateAWSSession()
-	svc := terrafire.CreateEC2Service(group.Region, sesh)
-	plan, planerr := createDestroyPlan(group, svc)
+	svcs, err := createServices(group)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	scope := terrafire.DestroyScope{Tier: destroyTier, Instances: destroyInstances}
+	plan, planerr := terrafire.CreateDestroyPlan(group, svcs, scope)
 	if planerr != nil {
 		errorLog.Fatal(planerr)
 	}
 
 	// show any errors else prompt before total annihilation
-	if len(plan.Errors) > 0 {
+	if !plan.OK() {
 		infoLog.Println("Error(s) in destroy plan")
 		for errIdx := range plan.Errors {
 			infoLog.Println(plan.Errors[errIdx])
 		}
+	} else if len(plan.DestroyOrder()) == 0 {
+		infoLog.Println("Plan looks OK, but there is nothing left to destroy.")
 	} else {
-		infoLog.Println("Plan looks OK, Are you sure you want to destroy these resources?")
-
-		for i := range plan.Group.Tiers {
-			tier := plan.Group.Tiers[i]
-			for idx := range tier.Instances {
-				inst := tier.Instances[idx]
-				infoLog.Printf(" - %s (%s)\n", inst.Name, "ec2 instance")
+		infoLog.Printf("Plan looks OK (%s), Are you sure you want to destroy these resources?", plan.Scope)
+
+		for _, tierName := range plan.DestroyOrder() {
+			infoLog.Printf("Tier: %s", tierName)
+			for _, pi := range plan.InstancesWithAction(terrafire.PlanActionDestroy) {
+				if pi.Tier == tierName {
+					infoLog.Printf(" - %s (%s)\n", pi.Name, "ec2 instance")
+				}
+			}
+			for _, rec := range plan.TierRecords(tierName) {
+				infoLog.Printf(" - %s (route53 %s record)\n", rec.Name(), aws.StringValue(rec.RecordSet.Type))
 			}
 		}
+		infoLog.Printf("Tiers will be destroyed in this order, waiting for each to terminate: %s", strings.Join(plan.DestroyOrder(), ", "))
 
 		// Prompt and read for "yes" in order to destroy all the things
 		reader := bufio.NewReader(os.Stdin)
 		infoLog.Printf("If you're absolutely sure you want to destroy the \nabove resources, enter \"%s\" to proceed.", destroyOk)
 		text, _ := reader.ReadString('\n')
-		debugLog.Printf("Instance IDs that are about to be destroyed: %v", plan.InstanceIds)
+		debugLog.Printf("Instance IDs that are about to be destroyed: %v", plan.InstanceIDs())
 		if strings.TrimSpace(text) == destroyOk {
-			flt := &ec2.TerminateInstancesInput{
-				InstanceIds: aws.StringSlice(plan.InstanceIds),
-			}
-			termOut, err := svc.TerminateInstances(flt)
-			if err != nil {
-				panic(err)
+			// tear down tier by tier, outermost first, so inner tiers outlive the ones that depend on them
+			for _, tierName := range plan.DestroyOrder() {
+				records := plan.TierRecords(tierName)
+				ids := plan.TierInstanceIDs(tierName)
+				infoLog.Printf("Destroying tier: %s", tierName)
+				r53err := terrafire.DeleteRoute53Records(svcs.Route53, records, infoLog)
+				if r53err != nil {
+					errorLog.Fatal(r53err)
+				}
+				termerr := terrafire.TerminateInstances(svcs.EC2, ids, infoLog)
+				if termerr != nil {
+					errorLog.Fatal(termerr)
+				}
+				waiterr := terrafire.WaitForInstanceState(svcs.EC2, ids, ec2.InstanceStateNameTerminated, infoLog)
+				if waiterr != nil {
+					errorLog.Fatal(waiterr)
+				}
 			}
-			debugLog.Printf("Terminate output: %v", termOut)
+			infoLog.Printf("Destroyed (%s).", plan.Scope)
 		} else {
 			infoLog.Print("No problem, we won't be destroying anything this time. \nFeel free to re-run destroy when you're feeling more destructive.")
 		}
@@ -330,6 +561,45 @@ func runDestroy(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// util - true if the instance was launched by this run (rather than resumed)
+func launchedNow(launched []string, inst terrafire.EC2InstanceLive) bool {
+	for _, id := range launched {
+		if id == inst.InstanceID {
+			return true
+		}
+	}
+	return false
+}
+
+// util - bail out of a failed apply, first cleaning up everything this run created if asked to
+func failApply(svcs terrafire.Services, launched []string, created []terrafire.PlanRecord, err error) {
+	errorLog.Printf("Apply failed: %s", err)
+	if !rollbackOnFailure {
+		if len(launched) > 0 {
+			infoLog.Printf("Instances launched by this run are still running: %v", launched)
+			infoLog.Println("Re-run with --rollback-on-failure to have them cleaned up automatically.")
+		}
+		os.Exit(1)
+	}
+
+	infoLog.Println("Rolling back everything created by this run....")
+	report := terrafire.Rollback(svcs, launched, created, infoLog)
+	infoLog.Println("Rollback report:")
+	for _, id := range report.Terminated {
+		infoLog.Printf(" - terminated: %s (ec2 instance)", id)
+	}
+	for _, desc := range report.Deleted {
+		infoLog.Printf(" - deleted: %s", desc)
+	}
+	for _, failure := range report.Failed {
+		infoLog.Printf(" - NOT cleaned up: %s", failure)
+	}
+	if !report.OK() {
+		errorLog.Println("Rollback was incomplete, the resources above need to be cleaned up by hand.")
+	}
+	os.Exit(1)
+}
+
 // util - intialize the loggers
 func initLoggers(infoWriter, debugWriter, errorWriter io.Writer) {
 	if ourConfig.Debug {
@@ -351,7 +621,7 @@ func getGroup() (terrafire.GroupConfig, error) {
 	for _, grp := range ourConfig.Groups {
 		if grp.Name == ourConfig.Group {
 			if grp.Region != "" {
-				return grp, nil
+				return terrafire.ExpandGroup(grp)
 			}
 			return terrafire.GroupConfig{}, fmt.Errorf("terraform group '%s' must have a region defined", ourConfig.Group)
 		}
@@ -359,6 +629,37 @@ func getGroup() (terrafire.GroupConfig, error) {
 	return terrafire.GroupConfig{}, fmt.Errorf("terrafire group '%s' not found, run the 'groups' command to see all groups", ourConfig.Group)
 }
 
+// util - create the services for a group, real AWS or the file-backed simulation
+func createServices(group terrafire.GroupConfig) (terrafire.Services, error) {
+	switch ourConfig.Backend {
+	case backendAWS, "":
+		sesh := terrafire.CreateAWSSession()
+		endpoints := ourConfig.GroupEndpoints(group)
+		debugLog.Printf("Using AWS backend, endpoints: %s", endpoints)
+		return terrafire.NewAWSServices(group.Region, endpoints, sesh), nil
+	case backendSim:
+		debugLog.Printf("Using simulated backend, state file: %s", ourConfig.SimState)
+		state, err := terrafire.OpenSimState(ourConfig.SimState)
+		if err != nil {
+			return terrafire.Services{}, err
+		}
+		// a new state is empty, only seed adds what the group refers to so the plan can report anything missing first
+		if state.IsNew() {
+			infoLog.Printf("%s doesn't exist yet, the simulated backend starts out empty, run 'seed' to add what group %s refers to", ourConfig.SimState, group.Name)
+		}
+		return terrafire.NewSimServices(state), nil
+	}
+	return terrafire.Services{}, fmt.Errorf("unknown backend '%s', must be '%s' or '%s'", ourConfig.Backend, backendAWS, backendSim)
+}
+
+// util - run the post launch commands, simulated instances only get the noop run
+func postProcess(group terrafire.GroupConfig) error {
+	if ourConfig.Backend == backendSim {
+		return terrafire.PostProcessInstancesNoop(group, infoLog)
+	}
+	return terrafire.PostProcessInstances(group, infoLog)
+}
+
 // map instanceMapLive (map of id to live instance data) and instanceMap (map of id to name) into allInstanceData (map of name to live instance data)
 func combineInstanceData(tier terrafire.EC2InstanceTier, instanceMap map[string]terrafire.EC2Instance, instanceMapLive map[string]*ec2.Instance, allInstanceData map[string]terrafire.EC2InstanceLive) error {
 	if len(instanceMap) != len(instanceMapLive) {
@@ -373,6 +674,10 @@ func combineInstanceData(tier terrafire.EC2InstanceTier, instanceMap map[string]
 		newInst.PrivateDnsName = aws.StringValue(liveInst.PrivateDnsName)
 		newInst.PublicIpAddress = aws.StringValue(liveInst.PublicIpAddress)
 		newInst.PublicDnsName = aws.StringValue(liveInst.PublicDnsName)
+		newInst.Market = terrafire.MarketOnDemand
+		if aws.StringValue(liveInst.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot {
+			newInst.Market = terrafire.MarketSpot
+		}
 		allInstanceData[v.Name] = newInst
 	}
 	return nil
@@ -392,114 +697,3 @@ func debugConfig() {
 	debugLog.Printf("Terrafire(viper) { %s }", vprDbg)
 	debugLog.Printf("Terrafire(parsed): { %v }", ourConfig)
 }
-
-/*************  PLAN STUFF *************/
-
-// TerrafirePlan - all the things that will be created as well as a list of any errors
-type TerrafirePlan struct {
-	Group  terrafire.GroupConfig
-	Errors []string
-}
-
-// TerrafireDestroyPlan - all the things that will be created as well as a list of any errors
-type TerrafireDestroyPlan struct {
-	TerrafirePlan
-	InstanceIds []string
-}
-
-// create the plan of attack for instantiating all the things
-func createPlan(group terrafire.GroupConfig, svc *ec2.EC2) (TerrafirePlan, error) {
-
-	plan := TerrafirePlan{Group: group}
-	instances, used, err := gatherPlanData(group, svc)
-	if err != nil {
-		return plan, err
-	}
-
-	// step 2 - check for existing live instances and build Error list
-	errors := make([]string, 0)
-	for instIdx := range instances {
-		inst := instances[instIdx]
-		// it's ok if there's one that's terminated
-		if aws.StringValue(inst.State.Name) == ec2.InstanceStateNameTerminated {
-			continue
-		}
-		tagName := terrafire.GetInstanceTag("Name", inst)
-		if tagName == "" {
-			// TODO figure out what this case is ?
-			errorLog.Println("Null tagname found for instance. ", inst.InstanceId)
-			continue
-		}
-		if exists, _ := used[tagName]; exists {
-			errors = append(errors, "Instance already exists: "+tagName)
-		}
-	}
-	plan.Errors = errors
-
-	return plan, nil
-}
-
-// create the plan of attack for DESTROYING all the things
-func createDestroyPlan(group terrafire.GroupConfig, svc *ec2.EC2) (TerrafireDestroyPlan, error) {
-
-	plan := TerrafirePlan{Group: group}
-	instances, configed, err := gatherPlanData(group, svc)
-	if err != nil {
-		return TerrafireDestroyPlan{plan, []string{}}, err
-	}
-
-	// step 2 - validate plan
-	errors := make([]string, 0)
-	existing := make(map[string]bool, len(instances))
-	existingIds := make([]string, 0)
-	for instIdx := range instances {
-		inst := instances[instIdx]
-		tagName := terrafire.GetInstanceTag("Name", inst)
-		if tagName == "" {
-			errorLog.Println("Null tagname found for instance. ", inst.InstanceId)
-			continue
-		}
-		// check that our configuration matches actual AWS instances
-		existing[tagName] = true
-		existingIds = append(existingIds, aws.StringValue(inst.InstanceId))
-		if exists, _ := configed[tagName]; !exists {
-			errors = append(errors, "Instance: \""+tagName+"\" exists but is not configured!!")
-		}
-	}
-	// check that our configuration doesn't try to destroy non-existing nodes
-	for k := range configed {
-		if ok, _ := existing[k]; !ok {
-			errors = append(errors, "Instance: \""+k+"\" does not exist!!")
-		}
-	}
-	plan.Errors = errors
-	destPlan := TerrafireDestroyPlan{TerrafirePlan: plan, InstanceIds: existingIds}
-	return destPlan, nil
-}
-
-// gather up the config, the live instance info and make a list of configured (taken) names
-func gatherPlanData(group terrafire.GroupConfig, svc *ec2.EC2) ([]ec2.Instance, map[string]bool, error) {
-
-	// get existing instances in group
-	instances, err := terrafire.GetGroupInstances(group, svc)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// check for empty tiers (illegal)
-	for _, tier := range group.Tiers {
-		if len(tier.Instances) < 1 {
-			return nil, nil, errors.New("a tier must contain at least one instance")
-		}
-	}
-
-	// create a map of existing instance names
-	names := make(map[string]bool)
-	for i := range group.Tiers {
-		tier := group.Tiers[i]
-		for idx := range tier.Instances {
-			names[tier.Instances[idx].Name] = true
-		}
-	}
-	return instances, names, nil
-}
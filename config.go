@@ -1,9 +1,15 @@
 package terrafire
 
 import (
+	"bytes"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
 
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/mapstructure"
 )
 
 // BaseConfig - Our main config struct definition
@@ -11,19 +17,80 @@ type BaseConfig struct {
 	Debug        bool          `mapstructure:"debug"`
 	ShowTags     bool          `mapstructure:"showtags"`
 	TemplatePath string        `mapstructure:"templatepath"`
+	Backend      string        `mapstructure:"backend"`
+	SimState     string        `mapstructure:"simstate"`
+	Parallelism  int           `mapstructure:"parallelism"`
+	Endpoints    Endpoints     `mapstructure:"endpoints"`
 	Group        string        `mapstructure:"group"`
 	Groups       []GroupConfig `mapstructure:"groups"`
 }
 
+// GroupEndpoints - the group's endpoints, falling back to the global ones for any that aren't set
+func (bc BaseConfig) GroupEndpoints(gc GroupConfig) Endpoints {
+	eps := gc.Endpoints
+	if eps.EC2 == "" {
+		eps.EC2 = bc.Endpoints.EC2
+	}
+	if eps.Route53 == "" {
+		eps.Route53 = bc.Endpoints.Route53
+	}
+	if eps.STS == "" {
+		eps.STS = bc.Endpoints.STS
+	}
+	if eps.IAM == "" {
+		eps.IAM = bc.Endpoints.IAM
+	}
+	return eps
+}
+
 // TerraFireRunConfig - config composite of base config, current group and current tier
 type RunConfig struct {
 	BaseConfig
-	Group GroupConfig
-	Tier  EC2InstanceTier
+	Group      GroupConfig
+	Tier       EC2InstanceTier
+	Provenance Provenance // only set for a real apply
+}
+
+// Parallelism - how many of the tier's instances to launch at once, the tier's setting wins over the global one, default 1
+func (rc RunConfig) Parallelism() int {
+	if rc.Tier.Parallelism > 0 {
+		return rc.Tier.Parallelism
+	}
+	if rc.BaseConfig.Parallelism > 0 {
+		return rc.BaseConfig.Parallelism
+	}
+	return 1
+}
+
+// InstanceMarket - the market an instance asks for and its spot settings, the instance's win over the tier's
+func (rc RunConfig) InstanceMarket(inst EC2Instance) (string, SpotConfig) {
+	market := rc.Tier.Market
+	if inst.Market != "" {
+		market = inst.Market
+	}
+	if market == "" {
+		market = MarketOnDemand
+	}
+	spot := rc.Tier.Spot
+	if inst.Spot != (SpotConfig{}) {
+		spot = inst.Spot
+	}
+	return market, spot
+}
+
+// InstanceTags - the user tags for an instance in this tier, instance tags win over tier tags which win over group tags
+func (rc RunConfig) InstanceTags(inst EC2Instance) map[string]string {
+	tags := make(map[string]string)
+	for _, level := range []map[string]string{rc.Group.Tags, rc.Tier.Tags, inst.Tags} {
+		for k, v := range level {
+			tags[k] = v
+		}
+	}
+	return tags
 }
 
 func (bc BaseConfig) String() string {
-	s := fmt.Sprintf("TerraFireConfig{ debug: %t, show-tags: %t, group: %s, template path: %s, groups [", bc.Debug, bc.ShowTags, bc.Group, bc.TemplatePath)
+	s := fmt.Sprintf("TerraFireConfig{ debug: %t, show-tags: %t, group: %s, template path: %s, backend: %s, sim state: %s, endpoints: %s, parallelism: %d, groups [", bc.Debug, bc.ShowTags, bc.Group, bc.TemplatePath, bc.Backend, bc.SimState, bc.Endpoints, bc.Parallelism)
 	for _, gc := range bc.Groups {
 		s = s + gc.String()
 	}
@@ -37,11 +104,13 @@ type GroupConfig struct {
 	Region       string            `mapstructure:"region"`
 	PuppetMaster string            `mapstructure:"puppetmaster"`
 	YumRepo      string            `mapstructure:"yumrepo"`
+	Endpoints    Endpoints         `mapstructure:"endpoints"`
+	Tags         map[string]string `mapstructure:"tags"`
 	Tiers        []EC2InstanceTier `mapstructure:"tiers"`
 }
 
 func (gc GroupConfig) String() string {
-	s := fmt.Sprintf("GroupConfig {Name : %s, Tiers: [", gc.Name)
+	s := fmt.Sprintf("GroupConfig {Name : %s, Endpoints: %s, Tags: %v, Tiers: [", gc.Name, gc.Endpoints, gc.Tags)
 	for _, t := range gc.Tiers {
 		s = s + t.String()
 	}
@@ -60,14 +129,31 @@ func (gc GroupConfig) InstanceCount() int {
 	return count
 }
 
+// Endpoints - optional custom service endpoints (e.g. a local moto/localstack server or a proxy), empty means the AWS default
+type Endpoints struct {
+	EC2     string `mapstructure:"ec2"`
+	Route53 string `mapstructure:"route53"`
+	STS     string `mapstructure:"sts"`
+	IAM     string `mapstructure:"iam"`
+}
+
+func (eps Endpoints) String() string {
+	return fmt.Sprintf("Endpoints{ ec2: %s, route53: %s, sts: %s, iam: %s }", eps.EC2, eps.Route53, eps.STS, eps.IAM)
+}
+
 // EC2InstanceTier  - Teir config for a group
 type EC2InstanceTier struct {
-	Name      string        `mapstructure:"name"`
-	Instances []EC2Instance `mapstructure:"instances"`
+	Name        string            `mapstructure:"name"`
+	Parallelism int               `mapstructure:"parallelism"`
+	Market      string            `mapstructure:"market"`
+	Spot        SpotConfig        `mapstructure:"spot"`
+	Subnets     []SubnetConfig    `mapstructure:"subnets"` // used round-robin by instances without their own subnet
+	Tags        map[string]string `mapstructure:"tags"`
+	Instances   []EC2Instance     `mapstructure:"instances"`
 }
 
 func (et EC2InstanceTier) String() string {
-	s := fmt.Sprintf("EC2InstanceTier{ Name: %s, Instances: [", et.Name)
+	s := fmt.Sprintf("EC2InstanceTier{ Name: %s, Parallelism: %d, Market: %s, Tags: %v, Instances: [", et.Name, et.Parallelism, et.Market, et.Tags)
 	for _, t := range et.Instances {
 		s = s + fmt.Sprintf("EC2Instance{ %v }", t)
 	}
@@ -89,11 +175,19 @@ func (et EC2InstanceTier) GetInstance(name string) *EC2Instance {
 type EC2Instance struct {
 	Type              string            `mapstructure:"type"`
 	Name              string            `mapstructure:"name"`
-	AMI               string            `mapstructure:"ami"`
+	Count             int               `mapstructure:"count"`
+	AMI               AMIConfig         `mapstructure:"ami"`
 	Zone              string            `mapstructure:"zone"`
-	Subnet            string            `mapstructure:"subnet"`
-	SecGroups         string            `mapstructure:"secgroups"`
+	PlacementGroup    string            `mapstructure:"placementgroup"`
+	Tenancy           string            `mapstructure:"tenancy"`  // default, dedicated or host
+	Affinity          string            `mapstructure:"affinity"` // default or host, only for host tenancy
+	HostID            string            `mapstructure:"hostid"`
+	Market            string            `mapstructure:"market"` // on-demand (the default) or spot
+	Spot              SpotConfig        `mapstructure:"spot"`
+	Subnet            SubnetConfig      `mapstructure:"subnet"`
+	SecGroups         []string          `mapstructure:"secgroups"` // names or ids, a comma separated string works too
 	KeyName           string            `mapstructure:"keyname"`
+	InstanceProfile   string            `mapstructure:"instanceprofile"` // name or ARN
 	Hostname          string            `mapstructure:"hostname"`
 	ElasticIPID       string            `mapstructure:"elasticipid"`
 	Route53           Route53Config     `mapstructure:"route53"`
@@ -101,11 +195,168 @@ type EC2Instance struct {
 	Bootstrap         BootTemplates     `mapstructure:"bootstrap"`
 	UserData          string            `mapstructure:"userdata"`
 	Properties        map[string]string `mapstructure:"properties"`
+	Tags              map[string]string `mapstructure:"tags"`
+	Volumes           []EBSVolume       `mapstructure:"volumes"`
 	PostLaunch        PostLaunch        `mapstructure:"postlaunch"`
+	Index             int               `mapstructure:"-"` // 1 based position within Count, set by ExpandGroup
 }
 
 func (inst EC2Instance) String() string {
-	return fmt.Sprintf("name: %s, hostname: %s, zone: %s, type: %s, subnet: %s, sec-groups: %s, ami: %s, public ip? %t, elastic ip: %s, route53 zone: %s, user data: %s", inst.Name, inst.Hostname, inst.Zone, inst.Type, inst.Subnet, inst.SecGroups, inst.AMI, inst.AssociatePublicIP, inst.ElasticIPID, inst.Route53.ZoneID, inst.UserData)
+	return fmt.Sprintf("name: %s, index: %d, hostname: %s, zone: %s, placement group: %s, tenancy: %s, market: %s, type: %s, subnet: %s, sec-groups: %v, instance profile: %s, ami: %s, public ip? %t, elastic ip: %s, route53 zone: %s, tags: %v, user data: %s", inst.Name, inst.Index, inst.Hostname, inst.Zone, inst.PlacementGroup, inst.Tenancy, inst.Market, inst.Type, inst.Subnet, inst.SecGroups, inst.InstanceProfile, inst.AMI, inst.AssociatePublicIP, inst.ElasticIPID, inst.Route53.ZoneID, inst.Tags, inst.UserData)
+}
+
+// Route53FQDN - the instance's route53 name (name + suffix), empty if it has no route53 config
+func (inst EC2Instance) Route53FQDN() string {
+	if inst.Route53.ZoneID == "" || inst.Route53.Suffix == "" {
+		return ""
+	}
+	return inst.Name + "." + inst.Route53.Suffix
+}
+
+// markets an instance can launch in
+const (
+	MarketOnDemand = "on-demand"
+	MarketSpot     = "spot"
+)
+
+// SpotConfig - spot request settings, only used with the spot market
+type SpotConfig struct {
+	MaxPrice     string `mapstructure:"maxprice"`     // empty is the on-demand price
+	Interruption string `mapstructure:"interruption"` // terminate (the default), stop or hibernate
+	Fallback     bool   `mapstructure:"fallback"`     // launch on-demand when there is no spot capacity
+}
+
+// AMIConfig - an AMI id, or owner + name pattern + architecture resolved to the newest matching image at plan time, a
+// plain string in the config is the id
+type AMIConfig struct {
+	ID           string `mapstructure:"id"`
+	Owner        string `mapstructure:"owner"`
+	Name         string `mapstructure:"name"` // * and ? wildcards
+	Architecture string `mapstructure:"architecture"`
+}
+
+// AMIOwnerRequired - why a filter without an owner is refused, anyone can publish a public image with a matching name
+const AMIOwnerRequired = "a filter needs an owner, without one any account's public image could match"
+
+// IsFilter - true if the AMI is looked up rather than given by id
+func (ami AMIConfig) IsFilter() bool {
+	return ami.Owner != "" || ami.Name != "" || ami.Architecture != ""
+}
+
+func (ami AMIConfig) String() string {
+	if !ami.IsFilter() {
+		return ami.ID
+	}
+	s := fmt.Sprintf("owner: %s, name: %s, architecture: %s", ami.Owner, ami.Name, ami.Architecture)
+	if ami.ID != "" {
+		s = ami.ID + " (" + s + ")"
+	}
+	return s
+}
+
+// SubnetConfig - a subnet id, or a subnet looked up at plan time by its Name tag or by vpc + zone + tags, a plain string
+// in the config is the id
+type SubnetConfig struct {
+	ID   string            `mapstructure:"id"`
+	Name string            `mapstructure:"name"`
+	VPC  string            `mapstructure:"vpc"`
+	Zone string            `mapstructure:"zone"` // the instance's zone when empty
+	Tags map[string]string `mapstructure:"tags"`
+}
+
+// IsZero - true if no subnet is configured
+func (sc SubnetConfig) IsZero() bool {
+	return sc.ID == "" && !sc.IsSelector()
+}
+
+// IsSelector - true if the subnet is looked up rather than given by id
+func (sc SubnetConfig) IsSelector() bool {
+	return sc.Name != "" || sc.VPC != "" || sc.Zone != "" || len(sc.Tags) > 0
+}
+
+func (sc SubnetConfig) String() string {
+	if !sc.IsSelector() {
+		return sc.ID
+	}
+	s := ""
+	add := func(key, value string) {
+		if value != "" {
+			if s != "" {
+				s = s + ", "
+			}
+			s = s + key + ": " + value
+		}
+	}
+	add("name", sc.Name)
+	add("vpc", sc.VPC)
+	add("zone", sc.Zone)
+	keys := make([]string, 0, len(sc.Tags))
+	for k := range sc.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add("tag:"+k, sc.Tags[k])
+	}
+	if sc.ID != "" {
+		s = sc.ID + " (" + s + ")"
+	}
+	return s
+}
+
+// ConfigDecodeHook - the decode hooks for the config, viper's defaults plus the short (string) forms of the structs that have one
+func ConfigDecodeHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		stringToIDHook,
+	)
+}
+
+// util - decode a plain string AMI or subnet as its id
+func stringToIDHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String {
+		return data, nil
+	}
+	switch to {
+	case reflect.TypeOf(AMIConfig{}):
+		return AMIConfig{ID: data.(string)}, nil
+	case reflect.TypeOf(SubnetConfig{}):
+		return SubnetConfig{ID: data.(string)}, nil
+	}
+	return data, nil
+}
+
+// EBSVolume - an EBS volume attached at launch, naming the root device changes the root volume
+type EBSVolume struct {
+	Device              string `mapstructure:"device"`
+	Size                int64  `mapstructure:"size"` // GiB
+	Type                string `mapstructure:"type"` // gp2, gp3, io1, io2, st1, sc1 or standard
+	IOPS                int64  `mapstructure:"iops"`
+	Throughput          int64  `mapstructure:"throughput"` // MiB/s, gp3 only
+	Encrypted           bool   `mapstructure:"encrypted"`
+	KMSKeyID            string `mapstructure:"kmskeyid"`
+	DeleteOnTermination *bool  `mapstructure:"deleteontermination"` // nil leaves the EC2 default
+}
+
+func (vol EBSVolume) String() string {
+	s := fmt.Sprintf("%s: %dGiB %s", vol.Device, vol.Size, vol.Type)
+	if vol.IOPS > 0 {
+		s = s + fmt.Sprintf(", %d iops", vol.IOPS)
+	}
+	if vol.Throughput > 0 {
+		s = s + fmt.Sprintf(", %dMiB/s", vol.Throughput)
+	}
+	if vol.Encrypted {
+		s = s + ", encrypted"
+		if vol.KMSKeyID != "" {
+			s = s + " (" + vol.KMSKeyID + ")"
+		}
+	}
+	if vol.DeleteOnTermination != nil && !*vol.DeleteOnTermination {
+		s = s + ", kept on termination"
+	}
+	return s
 }
 
 // Route53Config - struct for Route53 upsert/delete
@@ -130,6 +381,86 @@ type BootTemplates struct {
 	Footer  string `mapstructure:"footer"`
 }
 
+// ReplicaContext - what name, hostname and route53 suffix patterns can refer to, e.g. web{{.Index | printf "%02d"}}
+type ReplicaContext struct {
+	Index int // 1 based
+	Count int
+	Group string
+	Tier  string
+}
+
+// ExpandGroup - expand every instance with a count (or a name pattern) into that many instances, each with its own
+// index and with its name, hostname and route53 suffix patterns rendered, an error for a bad pattern or duplicate names.
+// Instances without a subnet are then given the tier's subnets round-robin.
+func ExpandGroup(group GroupConfig) (GroupConfig, error) {
+	expanded := group
+	expanded.Tiers = make([]EC2InstanceTier, 0, len(group.Tiers))
+	seen := make(map[string]string)
+	for _, tier := range group.Tiers {
+		et := tier
+		et.Instances = make([]EC2Instance, 0, len(tier.Instances))
+		for _, inst := range tier.Instances {
+			count := inst.Count
+			if count < 1 {
+				count = 1
+			}
+			if count > 1 && !strings.Contains(inst.Name, "{{") {
+				return group, fmt.Errorf("instance '%s' in tier '%s' has count %d but its name has no pattern to make the names unique", inst.Name, tier.Name, count)
+			}
+			if count > 1 && inst.ElasticIPID != "" {
+				return group, fmt.Errorf("instance '%s' in tier '%s' has count %d but an elastic IP can only go to one instance", inst.Name, tier.Name, count)
+			}
+			for idx := 1; idx <= count; idx++ {
+				ctx := ReplicaContext{Index: idx, Count: count, Group: group.Name, Tier: tier.Name}
+				replica := inst
+				replica.Index = idx
+				var err error
+				if replica.Name, err = renderNamePattern(inst.Name, ctx); err != nil {
+					return group, err
+				}
+				if replica.Hostname, err = renderNamePattern(inst.Hostname, ctx); err != nil {
+					return group, err
+				}
+				if replica.Route53.Suffix, err = renderNamePattern(inst.Route53.Suffix, ctx); err != nil {
+					return group, err
+				}
+				if other, dup := seen[replica.Name]; dup {
+					return group, fmt.Errorf("instance name '%s' in tier '%s' is already used in tier '%s'", replica.Name, tier.Name, other)
+				}
+				seen[replica.Name] = tier.Name
+				et.Instances = append(et.Instances, replica)
+			}
+		}
+		if len(tier.Subnets) > 0 {
+			next := 0
+			for idx := range et.Instances {
+				if et.Instances[idx].Subnet.IsZero() {
+					et.Instances[idx].Subnet = tier.Subnets[next%len(tier.Subnets)]
+					next++
+				}
+			}
+		}
+		expanded.Tiers = append(expanded.Tiers, et)
+	}
+	return expanded, nil
+}
+
+// util - render a name pattern, plain names are returned as is
+func renderNamePattern(pattern string, ctx ReplicaContext) (string, error) {
+	if !strings.Contains(pattern, "{{") {
+		return pattern, nil
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return "", fmt.Errorf("bad name pattern '%s': %s", pattern, err)
+	}
+	var buffy bytes.Buffer
+	if err := tmpl.Execute(&buffy, ctx); err != nil {
+		return "", fmt.Errorf("bad name pattern '%s': %s", pattern, err)
+	}
+	return buffy.String(), nil
+}
+
 // EC2InstanceLive - config plus some live instance properties
 type EC2InstanceLive struct {
 	EC2Instance
@@ -138,6 +469,7 @@ type EC2InstanceLive struct {
 	PrivateIpAddress string
 	PublicIpAddress  string
 	PublicDnsName    string
+	Market           string // the market the instance actually launched in
 }
 
 // Apply - pull in live instance properties
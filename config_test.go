@@ -0,0 +1,138 @@
+package terrafire
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+func TestGroupEndpoints(t *testing.T) {
+	base := BaseConfig{Endpoints: Endpoints{EC2: "http://global:4566", Route53: "http://global:4566"}}
+	group := GroupConfig{Endpoints: Endpoints{EC2: "http://group:4566"}}
+
+	want := Endpoints{EC2: "http://group:4566", Route53: "http://global:4566"}
+	if got := base.GroupEndpoints(group); got != want {
+		t.Errorf("GroupEndpoints() = %s, want %s", got, want)
+	}
+	if got := (BaseConfig{}).GroupEndpoints(GroupConfig{}); got != (Endpoints{}) {
+		t.Errorf("GroupEndpoints() with nothing set = %s, want the AWS defaults", got)
+	}
+}
+
+func TestParallelism(t *testing.T) {
+	cases := []struct {
+		global, tier, want int
+	}{
+		{0, 0, 1},
+		{4, 0, 4},
+		{4, 2, 2},
+		{0, 3, 3},
+	}
+	for _, tc := range cases {
+		config := RunConfig{BaseConfig: BaseConfig{Parallelism: tc.global}, Tier: EC2InstanceTier{Parallelism: tc.tier}}
+		if got := config.Parallelism(); got != tc.want {
+			t.Errorf("Parallelism() with global %d, tier %d = %d, want %d", tc.global, tc.tier, got, tc.want)
+		}
+	}
+}
+
+func TestExpandGroup(t *testing.T) {
+	group := GroupConfig{Name: "g", Tiers: []EC2InstanceTier{
+		{Name: "db", Instances: []EC2Instance{{Name: "db01", Hostname: "db01.local"}}},
+		{Name: "web", Instances: []EC2Instance{{
+			Name:     `{{.Group}}-{{.Tier}}{{.Index | printf "%02d"}}`,
+			Hostname: "web{{.Index}}of{{.Count}}",
+			Route53:  Route53Config{Suffix: "{{.Tier}}.example.com"},
+			Count:    2,
+		}}},
+	}}
+	expanded, err := ExpandGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, hostnames []string
+	for _, tier := range expanded.Tiers {
+		for _, inst := range tier.Instances {
+			names = append(names, inst.Name)
+			hostnames = append(hostnames, inst.Hostname)
+		}
+	}
+	if want := []string{"db01", "g-web01", "g-web02"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+	if want := []string{"db01.local", "web1of2", "web2of2"}; !reflect.DeepEqual(hostnames, want) {
+		t.Errorf("hostnames = %v, want %v", hostnames, want)
+	}
+	if suffix := expanded.Tiers[1].Instances[1].Route53.Suffix; suffix != "web.example.com" {
+		t.Errorf("route53 suffix = %q, want web.example.com", suffix)
+	}
+}
+
+func TestExpandGroupErrors(t *testing.T) {
+	cases := []struct {
+		tiers []EC2InstanceTier
+		err   string
+	}{
+		{[]EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web", Count: 2}}}}, "has count 2 but its name has no pattern"},
+		{[]EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web{{.Index}}", Count: 2, ElasticIPID: "eipalloc-1"}}}}, "an elastic IP can only go to one instance"},
+		{[]EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web{{.Nope}}", Count: 2}}}}, "bad name pattern 'web{{.Nope}}'"},
+		{[]EC2InstanceTier{
+			{Name: "db", Instances: []EC2Instance{{Name: "web2"}}},
+			{Name: "web", Instances: []EC2Instance{{Name: "web{{.Index}}", Count: 2}}},
+		}, "instance name 'web2' in tier 'web' is already used in tier 'db'"},
+	}
+	for _, tc := range cases {
+		if _, err := ExpandGroup(GroupConfig{Name: "g", Tiers: tc.tiers}); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("error = %v, want one containing %q", err, tc.err)
+		}
+	}
+}
+
+func TestConfigDecodeHook(t *testing.T) {
+	raw := map[string]interface{}{
+		"web1": map[string]interface{}{"ami": "ami-123", "secgroups": "web, ssh"},
+		"web2": map[string]interface{}{"ami": map[string]interface{}{"owner": "self", "name": "base-*"}},
+	}
+	var insts map[string]EC2Instance
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{DecodeHook: ConfigDecodeHook(), Result: &insts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(raw); err != nil {
+		t.Fatal(err)
+	}
+	if ami := insts["web1"].AMI; ami != (AMIConfig{ID: "ami-123"}) {
+		t.Errorf("string ami decoded as %+v, want just the id", ami)
+	}
+	if ami := insts["web2"].AMI; ami != (AMIConfig{Owner: "self", Name: "base-*"}) {
+		t.Errorf("ami filter decoded as %+v", ami)
+	}
+	if sgs := insts["web1"].SecGroups; len(sgs) != 2 {
+		t.Errorf("secgroups decoded as %q, want the comma separated string split", sgs)
+	}
+}
+
+func TestExpandGroupTierSubnets(t *testing.T) {
+	group := GroupConfig{Name: "g", Tiers: []EC2InstanceTier{{
+		Name:    "web",
+		Subnets: []SubnetConfig{{ID: "subnet-a"}, {ID: "subnet-b"}},
+		Instances: []EC2Instance{
+			{Name: "web{{.Index}}", Count: 2},
+			{Name: "pinned", Subnet: SubnetConfig{ID: "subnet-c"}},
+			{Name: "last"},
+		},
+	}}}
+	expanded, err := ExpandGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subnets []string
+	for _, inst := range expanded.Tiers[0].Instances {
+		subnets = append(subnets, inst.Subnet.ID)
+	}
+	if want := []string{"subnet-a", "subnet-b", "subnet-c", "subnet-a"}; !reflect.DeepEqual(subnets, want) {
+		t.Errorf("subnets = %v, want the tier's round-robin around the pinned one", subnets)
+	}
+}
@@ -0,0 +1,1021 @@
+package terrafire
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// FakeState - in-memory stand-in for the EC2/Route53 resources terrafire touches
+type FakeState struct {
+	Instances  []*ec2.Instance
+	Addresses  []*ec2.Address
+	Subnets    []*ec2.Subnet
+	SecGroups  []*ec2.SecurityGroup
+	Images     []*ec2.Image
+	Profiles   []*iam.InstanceProfile
+	Spot       []*ec2.SpotInstanceRequest
+	KeyPairs   []*ec2.KeyPairInfo
+	Zones      []*route53.HostedZone
+	RecordSets map[string][]*route53.ResourceRecordSet
+	Failures   map[string]string // operation name -> error message, for rehearsing failures
+	CallerARN  string            // the identity FakeSTS reports, FakeCallerARN if empty
+	NoSpot     bool              // spot launches fail with InsufficientInstanceCapacity
+	NextID     int
+
+	mu    sync.Mutex
+	path  string
+	fresh bool
+}
+
+// NewFakeState - create an empty fake state
+func NewFakeState() *FakeState {
+	return &FakeState{RecordSets: make(map[string][]*route53.ResourceRecordSet)}
+}
+
+// AddAddress - register an elastic IP allocation so it can be associated
+func (fs *FakeState) AddAddress(allocationID, publicIP string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.Addresses = append(fs.Addresses, fakeAddress(allocationID, publicIP))
+}
+
+// SetSpotCapacity - whether spot launches succeed, without capacity they fail like EC2 does when there is none
+func (fs *FakeState) SetSpotCapacity(available bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.NoSpot = !available
+}
+
+// Fail - make every call of an operation (e.g. "RunInstances") fail with the given message, an empty message clears it
+func (fs *FakeState) Fail(operation, message string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Failures == nil {
+		fs.Failures = make(map[string]string)
+	}
+	if message == "" {
+		delete(fs.Failures, operation)
+		return
+	}
+	fs.Failures[operation] = message
+}
+
+// util - the injected error for an operation, if any, caller must hold the lock
+func (fs *FakeState) failure(operation string) error {
+	if msg, ok := fs.Failures[operation]; ok {
+		return awserr.New("SimulatedFailure", fmt.Sprintf("%s: %s", operation, msg), nil)
+	}
+	return nil
+}
+
+// util - next unique number for ids and addresses, caller must hold the lock
+func (fs *FakeState) nextID() int {
+	fs.NextID++
+	return fs.NextID
+}
+
+// util - find an instance by id, caller must hold the lock
+func (fs *FakeState) findInstance(id string) *ec2.Instance {
+	for _, inst := range fs.Instances {
+		if aws.StringValue(inst.InstanceId) == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// util - find a spot request by id, caller must hold the lock
+func (fs *FakeState) findSpotRequest(id string) *ec2.SpotInstanceRequest {
+	for _, req := range fs.Spot {
+		if aws.StringValue(req.SpotInstanceRequestId) == id {
+			return req
+		}
+	}
+	return nil
+}
+
+// util - find an elastic IP by allocation id, caller must hold the lock
+func (fs *FakeState) findAddress(allocationID string) *ec2.Address {
+	for _, addr := range fs.Addresses {
+		if aws.StringValue(addr.AllocationId) == allocationID {
+			return addr
+		}
+	}
+	return nil
+}
+
+// AddSubnet - register a subnet in an availability zone and vpc
+func (fs *FakeState) AddSubnet(subnetID, zone, vpcID string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.Subnets = append(fs.Subnets, fakeSubnet(subnetID, zone, vpcID))
+}
+
+// util - find a subnet by id, caller must hold the lock
+func (fs *FakeState) findSubnet(subnetID string) *ec2.Subnet {
+	for _, subnet := range fs.Subnets {
+		if aws.StringValue(subnet.SubnetId) == subnetID {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// AddSecurityGroup - register a security group in a vpc
+func (fs *FakeState) AddSecurityGroup(groupID, name, vpcID string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.SecGroups = append(fs.SecGroups, fakeSecurityGroup(groupID, name, vpcID))
+}
+
+// util - find a security group by id, or by name within a vpc, caller must hold the lock
+func (fs *FakeState) findSecurityGroup(vpcID, nameOrID string) *ec2.SecurityGroup {
+	for _, sg := range fs.SecGroups {
+		if aws.StringValue(sg.GroupId) == nameOrID || (aws.StringValue(sg.GroupName) == nameOrID && aws.StringValue(sg.VpcId) == vpcID) {
+			return sg
+		}
+	}
+	return nil
+}
+
+// AddImage - register an available image
+func (fs *FakeState) AddImage(imageID, owner, name, architecture string, created time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.Images = append(fs.Images, fakeImage(imageID, owner, name, architecture, created))
+}
+
+// util - find an image by id, caller must hold the lock
+func (fs *FakeState) findImage(imageID string) *ec2.Image {
+	for _, img := range fs.Images {
+		if aws.StringValue(img.ImageId) == imageID {
+			return img
+		}
+	}
+	return nil
+}
+
+// AddInstanceProfile - register an IAM instance profile
+func (fs *FakeState) AddInstanceProfile(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.Profiles = append(fs.Profiles, fakeInstanceProfile(name))
+}
+
+// util - find an instance profile by name, caller must hold the lock
+func (fs *FakeState) findInstanceProfile(name string) *iam.InstanceProfile {
+	for _, profile := range fs.Profiles {
+		if aws.StringValue(profile.InstanceProfileName) == name {
+			return profile
+		}
+	}
+	return nil
+}
+
+// AddKeyPair - register an EC2 key pair
+func (fs *FakeState) AddKeyPair(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.KeyPairs = append(fs.KeyPairs, fakeKeyPair(name))
+}
+
+// util - find a key pair by name, caller must hold the lock
+func (fs *FakeState) findKeyPair(name string) *ec2.KeyPairInfo {
+	for _, kp := range fs.KeyPairs {
+		if aws.StringValue(kp.KeyName) == name {
+			return kp
+		}
+	}
+	return nil
+}
+
+// AddHostedZone - register a route53 hosted zone
+func (fs *FakeState) AddHostedZone(zoneID, name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.Zones = append(fs.Zones, fakeHostedZone(zoneID, name))
+}
+
+// util - find a hosted zone by id, with or without the /hostedzone/ prefix, caller must hold the lock
+func (fs *FakeState) findHostedZone(zoneID string) *route53.HostedZone {
+	zoneID = strings.TrimPrefix(zoneID, "/hostedzone/")
+	for _, zone := range fs.Zones {
+		if strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/") == zoneID {
+			return zone
+		}
+	}
+	return nil
+}
+
+// FakeEC2 - EC2API implementation backed by a FakeState, an unknown id or name in a request fails the whole call like EC2 does
+type FakeEC2 struct {
+	State *FakeState
+}
+
+// NewFakeEC2 - create a fake EC2 service, a nil state starts empty
+func NewFakeEC2(state *FakeState) *FakeEC2 {
+	if state == nil {
+		state = NewFakeState()
+	}
+	return &FakeEC2{State: state}
+}
+
+// DescribeInstances - supports instance ids plus tag:*, instance-id and instance-state-name filters
+func (f *FakeEC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("DescribeInstances"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range input.InstanceIds {
+		if f.State.findInstance(aws.StringValue(id)) == nil {
+			return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+	}
+
+	res := &ec2.Reservation{ReservationId: aws.String("r-fake")}
+	for _, inst := range f.State.Instances {
+		if len(input.InstanceIds) > 0 && !containsString(aws.StringValueSlice(input.InstanceIds), aws.StringValue(inst.InstanceId)) {
+			continue
+		}
+		if !fakeInstanceMatches(inst, input.Filters) {
+			continue
+		}
+		res.Instances = append(res.Instances, awsutil.CopyOf(inst).(*ec2.Instance))
+	}
+
+	out := &ec2.DescribeInstancesOutput{}
+	if len(res.Instances) > 0 {
+		out.Reservations = []*ec2.Reservation{res}
+	}
+	return out, nil
+}
+
+// util - EC2's limit on user data, before it is base64 encoded
+const fakeMaxUserData = 16384
+
+// RunInstances - launch a single running instance, public addresses are assigned when requested
+func (f *FakeEC2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("RunInstances"); err != nil {
+		return nil, err
+	}
+	if key := aws.StringValue(input.KeyName); key != "" && f.State.findKeyPair(key) == nil {
+		return nil, awserr.New("InvalidKeyPair.NotFound", fmt.Sprintf("The key pair '%s' does not exist", key), nil)
+	}
+	if userData, err := base64.StdEncoding.DecodeString(aws.StringValue(input.UserData)); err != nil || len(userData) > fakeMaxUserData {
+		return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("User data is limited to %d bytes", fakeMaxUserData), nil)
+	}
+	if aws.BoolValue(input.DryRun) {
+		return nil, awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+	}
+
+	spot := input.InstanceMarketOptions != nil && aws.StringValue(input.InstanceMarketOptions.MarketType) == ec2.MarketTypeSpot
+	if spot && f.State.NoSpot {
+		return nil, awserr.New("InsufficientInstanceCapacity", "There is no Spot capacity available that matches your request.", nil)
+	}
+
+	n := f.State.nextID()
+	inst := &ec2.Instance{
+		InstanceId:       aws.String(fmt.Sprintf("i-%017x", n)),
+		ImageId:          input.ImageId,
+		InstanceType:     input.InstanceType,
+		KeyName:          input.KeyName,
+		LaunchTime:       aws.Time(time.Now().UTC()),
+		PrivateIpAddress: aws.String(fmt.Sprintf("10.0.%d.%d", n/250, n%250+4)),
+		PrivateDnsName:   aws.String(fmt.Sprintf("ip-10-0-%d-%d.ec2.internal", n/250, n%250+4)),
+		State:            fakeInstanceState(ec2.InstanceStateNameRunning),
+	}
+	for _, spec := range input.TagSpecifications {
+		if aws.StringValue(spec.ResourceType) == ec2.ResourceTypeInstance {
+			inst.Tags = mergeFakeTags(inst.Tags, spec.Tags)
+		}
+	}
+	if spot {
+		inst.InstanceLifecycle = aws.String(ec2.InstanceLifecycleTypeSpot)
+		inst.SpotInstanceRequestId = aws.String(fmt.Sprintf("sir-%08x", f.State.nextID()))
+		reqType := ec2.SpotInstanceTypeOneTime
+		if opts := input.InstanceMarketOptions.SpotOptions; opts != nil && opts.SpotInstanceType != nil {
+			reqType = aws.StringValue(opts.SpotInstanceType)
+		}
+		f.State.Spot = append(f.State.Spot, &ec2.SpotInstanceRequest{
+			SpotInstanceRequestId: inst.SpotInstanceRequestId,
+			InstanceId:            inst.InstanceId,
+			Type:                  aws.String(reqType),
+			State:                 aws.String(ec2.SpotInstanceStateActive),
+		})
+	}
+	if input.Placement != nil {
+		inst.Placement = awsutil.CopyOf(input.Placement).(*ec2.Placement)
+	}
+	if input.IamInstanceProfile != nil {
+		var profile *iam.InstanceProfile
+		for _, candidate := range f.State.Profiles {
+			if aws.StringValue(candidate.InstanceProfileName) == aws.StringValue(input.IamInstanceProfile.Name) || aws.StringValue(candidate.Arn) == aws.StringValue(input.IamInstanceProfile.Arn) {
+				profile = candidate
+			}
+		}
+		if profile == nil {
+			return nil, awserr.New("InvalidParameterValue", "Value for parameter iamInstanceProfile is invalid", nil)
+		}
+		inst.IamInstanceProfile = &ec2.IamInstanceProfile{Arn: profile.Arn, Id: profile.InstanceProfileId}
+	}
+	for _, bdm := range input.BlockDeviceMappings {
+		inst.BlockDeviceMappings = append(inst.BlockDeviceMappings, &ec2.InstanceBlockDeviceMapping{
+			DeviceName: bdm.DeviceName,
+			Ebs: &ec2.EbsInstanceBlockDevice{
+				VolumeId:            aws.String(fmt.Sprintf("vol-%017x", f.State.nextID())),
+				Status:              aws.String(ec2.AttachmentStatusAttached),
+				DeleteOnTermination: aws.Bool(bdm.Ebs == nil || bdm.Ebs.DeleteOnTermination == nil || aws.BoolValue(bdm.Ebs.DeleteOnTermination)),
+			},
+		})
+	}
+	if len(input.NetworkInterfaces) > 0 {
+		netSpec := input.NetworkInterfaces[0]
+		inst.SubnetId = netSpec.SubnetId
+		if subnet := f.State.findSubnet(aws.StringValue(netSpec.SubnetId)); subnet != nil {
+			if inst.Placement == nil {
+				inst.Placement = &ec2.Placement{}
+			}
+			if inst.Placement.AvailabilityZone == nil {
+				inst.Placement.AvailabilityZone = subnet.AvailabilityZone
+			}
+			inst.VpcId = subnet.VpcId
+		}
+		for _, grp := range netSpec.Groups {
+			sg := f.State.findSecurityGroup("", aws.StringValue(grp))
+			if sg == nil {
+				return nil, awserr.New("InvalidGroup.NotFound", fmt.Sprintf("The security group '%s' does not exist", aws.StringValue(grp)), nil)
+			}
+			inst.SecurityGroups = append(inst.SecurityGroups, &ec2.GroupIdentifier{GroupId: sg.GroupId, GroupName: sg.GroupName})
+		}
+		if aws.BoolValue(netSpec.AssociatePublicIpAddress) {
+			inst.PublicIpAddress = aws.String(fmt.Sprintf("54.0.%d.%d", n/250, n%250+4))
+			inst.PublicDnsName = aws.String(fmt.Sprintf("ec2-54-0-%d-%d.compute-1.amazonaws.com", n/250, n%250+4))
+		}
+	}
+	f.State.Instances = append(f.State.Instances, inst)
+	if err := f.State.persist(); err != nil {
+		return nil, err
+	}
+
+	return &ec2.Reservation{
+		ReservationId: aws.String(fmt.Sprintf("r-%017x", n)),
+		Instances:     []*ec2.Instance{awsutil.CopyOf(inst).(*ec2.Instance)},
+	}, nil
+}
+
+// TerminateInstances - instances go straight to terminated and give up any elastic IPs
+func (f *FakeEC2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("TerminateInstances"); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.TerminateInstancesOutput{}
+	for _, id := range input.InstanceIds {
+		inst := f.State.findInstance(aws.StringValue(id))
+		if inst == nil {
+			return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		prev := inst.State
+		inst.State = fakeInstanceState(ec2.InstanceStateNameTerminated)
+		// a persistent request that is still active goes back to open, EC2 would launch a replacement
+		if req := f.State.findSpotRequest(aws.StringValue(inst.SpotInstanceRequestId)); req != nil && aws.StringValue(req.State) == ec2.SpotInstanceStateActive {
+			req.State = aws.String(ec2.SpotInstanceStateClosed)
+			if aws.StringValue(req.Type) == ec2.SpotInstanceTypePersistent {
+				req.State = aws.String(ec2.SpotInstanceStateOpen)
+			}
+		}
+		inst.PublicIpAddress = nil
+		inst.PublicDnsName = nil
+		for _, addr := range f.State.Addresses {
+			if aws.StringValue(addr.InstanceId) == aws.StringValue(id) {
+				addr.AssociationId = nil
+				addr.InstanceId = nil
+			}
+		}
+		out.TerminatingInstances = append(out.TerminatingInstances, &ec2.InstanceStateChange{
+			InstanceId:    id,
+			PreviousState: prev,
+			CurrentState:  inst.State,
+		})
+	}
+	if err := f.State.persist(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CancelSpotInstanceRequests - cancelled requests never launch again, their instances keep running
+func (f *FakeEC2) CancelSpotInstanceRequests(input *ec2.CancelSpotInstanceRequestsInput) (*ec2.CancelSpotInstanceRequestsOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("CancelSpotInstanceRequests"); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.CancelSpotInstanceRequestsOutput{}
+	for _, id := range input.SpotInstanceRequestIds {
+		req := f.State.findSpotRequest(aws.StringValue(id))
+		if req == nil {
+			return nil, awserr.New("InvalidSpotInstanceRequestID.NotFound", fmt.Sprintf("The spot instance request ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		req.State = aws.String(ec2.SpotInstanceStateCancelled)
+		out.CancelledSpotInstanceRequests = append(out.CancelledSpotInstanceRequests, &ec2.CancelledSpotInstanceRequest{
+			SpotInstanceRequestId: id,
+			State:                 aws.String(ec2.CancelSpotInstanceRequestStateCancelled),
+		})
+	}
+	if err := f.State.persist(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AssociateAddress - associate a known elastic IP allocation with an instance
+func (f *FakeEC2) AssociateAddress(input *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("AssociateAddress"); err != nil {
+		return nil, err
+	}
+
+	inst := f.State.findInstance(aws.StringValue(input.InstanceId))
+	if inst == nil {
+		return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(input.InstanceId)), nil)
+	}
+	addr := f.State.findAddress(aws.StringValue(input.AllocationId))
+	if addr == nil {
+		return nil, awserr.New("InvalidAllocationID.NotFound", fmt.Sprintf("The allocation ID '%s' does not exist", aws.StringValue(input.AllocationId)), nil)
+	}
+	addr.AssociationId = aws.String(fmt.Sprintf("eipassoc-%08x", f.State.nextID()))
+	addr.InstanceId = inst.InstanceId
+	inst.PublicIpAddress = addr.PublicIp
+	if err := f.State.persist(); err != nil {
+		return nil, err
+	}
+	return &ec2.AssociateAddressOutput{AssociationId: addr.AssociationId}, nil
+}
+
+// DescribeSubnets - supports subnet ids plus tag:*, vpc-id and availability-zone filters
+func (f *FakeEC2) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("DescribeSubnets"); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.DescribeSubnetsOutput{}
+	for _, id := range input.SubnetIds {
+		subnet := f.State.findSubnet(aws.StringValue(id))
+		if subnet == nil {
+			return nil, awserr.New("InvalidSubnetID.NotFound", fmt.Sprintf("The subnet ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		out.Subnets = append(out.Subnets, awsutil.CopyOf(subnet).(*ec2.Subnet))
+	}
+	if len(input.SubnetIds) == 0 {
+		for _, subnet := range f.State.Subnets {
+			if fakeSubnetMatches(subnet, input.Filters) {
+				out.Subnets = append(out.Subnets, awsutil.CopyOf(subnet).(*ec2.Subnet))
+			}
+		}
+	}
+	return out, nil
+}
+
+// DescribeSecurityGroups - supports group ids plus group-name, group-id and vpc-id filters
+func (f *FakeEC2) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("DescribeSecurityGroups"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range input.GroupIds {
+		if f.State.findSecurityGroup("", aws.StringValue(id)) == nil {
+			return nil, awserr.New("InvalidGroup.NotFound", fmt.Sprintf("The security group '%s' does not exist", aws.StringValue(id)), nil)
+		}
+	}
+
+	out := &ec2.DescribeSecurityGroupsOutput{}
+	for _, sg := range f.State.SecGroups {
+		if len(input.GroupIds) > 0 && !containsString(aws.StringValueSlice(input.GroupIds), aws.StringValue(sg.GroupId)) {
+			continue
+		}
+		matches := true
+		for _, flt := range input.Filters {
+			var actual string
+			switch aws.StringValue(flt.Name) {
+			case "group-name":
+				actual = aws.StringValue(sg.GroupName)
+			case "group-id":
+				actual = aws.StringValue(sg.GroupId)
+			case "vpc-id":
+				actual = aws.StringValue(sg.VpcId)
+			}
+			matches = matches && containsString(aws.StringValueSlice(flt.Values), actual)
+		}
+		if matches {
+			out.SecurityGroups = append(out.SecurityGroups, awsutil.CopyOf(sg).(*ec2.SecurityGroup))
+		}
+	}
+	return out, nil
+}
+
+// DescribeImages - supports image ids and owners plus name (with wildcards), architecture and state filters
+func (f *FakeEC2) DescribeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("DescribeImages"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range input.ImageIds {
+		if f.State.findImage(aws.StringValue(id)) == nil {
+			return nil, awserr.New("InvalidAMIID.NotFound", fmt.Sprintf("The image id '[%s]' does not exist", aws.StringValue(id)), nil)
+		}
+	}
+	out := &ec2.DescribeImagesOutput{}
+	for _, img := range f.State.Images {
+		if len(input.ImageIds) > 0 && !containsString(aws.StringValueSlice(input.ImageIds), aws.StringValue(img.ImageId)) {
+			continue
+		}
+		if len(input.Owners) > 0 && !containsString(aws.StringValueSlice(input.Owners), aws.StringValue(img.OwnerId)) {
+			continue
+		}
+		matches := true
+		for _, flt := range input.Filters {
+			var actual string
+			switch aws.StringValue(flt.Name) {
+			case "name":
+				actual = aws.StringValue(img.Name)
+			case "architecture":
+				actual = aws.StringValue(img.Architecture)
+			case "state":
+				actual = aws.StringValue(img.State)
+			}
+			found := false
+			for _, pattern := range aws.StringValueSlice(flt.Values) {
+				ok, _ := path.Match(pattern, actual)
+				found = found || ok
+			}
+			matches = matches && found
+		}
+		if matches {
+			out.Images = append(out.Images, awsutil.CopyOf(img).(*ec2.Image))
+		}
+	}
+	return out, nil
+}
+
+// DescribeKeyPairs - supports key names only
+func (f *FakeEC2) DescribeKeyPairs(input *ec2.DescribeKeyPairsInput) (*ec2.DescribeKeyPairsOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("DescribeKeyPairs"); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.DescribeKeyPairsOutput{}
+	for _, name := range input.KeyNames {
+		kp := f.State.findKeyPair(aws.StringValue(name))
+		if kp == nil {
+			return nil, awserr.New("InvalidKeyPair.NotFound", fmt.Sprintf("The key pair '%s' does not exist", aws.StringValue(name)), nil)
+		}
+		out.KeyPairs = append(out.KeyPairs, awsutil.CopyOf(kp).(*ec2.KeyPairInfo))
+	}
+	if len(input.KeyNames) == 0 {
+		for _, kp := range f.State.KeyPairs {
+			out.KeyPairs = append(out.KeyPairs, awsutil.CopyOf(kp).(*ec2.KeyPairInfo))
+		}
+	}
+	return out, nil
+}
+
+// DescribeAddresses - supports allocation ids only
+func (f *FakeEC2) DescribeAddresses(input *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("DescribeAddresses"); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.DescribeAddressesOutput{}
+	for _, id := range input.AllocationIds {
+		addr := f.State.findAddress(aws.StringValue(id))
+		if addr == nil {
+			return nil, awserr.New("InvalidAllocationID.NotFound", fmt.Sprintf("The allocation ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		out.Addresses = append(out.Addresses, awsutil.CopyOf(addr).(*ec2.Address))
+	}
+	if len(input.AllocationIds) == 0 {
+		for _, addr := range f.State.Addresses {
+			out.Addresses = append(out.Addresses, awsutil.CopyOf(addr).(*ec2.Address))
+		}
+	}
+	return out, nil
+}
+
+// WaitUntilInstanceRunning - fake instances launch running, so this only fails for ones that can never get there
+func (f *FakeEC2) WaitUntilInstanceRunning(input *ec2.DescribeInstancesInput) error {
+	f.State.mu.Lock()
+	err := f.State.failure("WaitUntilInstanceRunning")
+	f.State.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	out, err := f.DescribeInstances(input)
+	if err != nil {
+		return err
+	}
+	for _, res := range out.Reservations {
+		for _, inst := range res.Instances {
+			if aws.StringValue(inst.State.Name) != ec2.InstanceStateNameRunning {
+				return awserr.New(request.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state", nil)
+			}
+		}
+	}
+	return nil
+}
+
+// FakeRoute53 - Route53API implementation backed by a FakeState
+type FakeRoute53 struct {
+	State *FakeState
+}
+
+// NewFakeRoute53 - create a fake Route53 service, a nil state starts empty
+func NewFakeRoute53(state *FakeState) *FakeRoute53 {
+	if state == nil {
+		state = NewFakeState()
+	}
+	return &FakeRoute53{State: state}
+}
+
+// ChangeResourceRecordSets - apply CREATE/UPSERT/DELETE changes to a zone's record sets
+func (f *FakeRoute53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("ChangeResourceRecordSets"); err != nil {
+		return nil, err
+	}
+
+	zoneID := aws.StringValue(input.HostedZoneId)
+	sets := append([]*route53.ResourceRecordSet(nil), f.State.RecordSets[zoneID]...)
+	for _, change := range input.ChangeBatch.Changes {
+		rrs := awsutil.CopyOf(change.ResourceRecordSet).(*route53.ResourceRecordSet)
+		rrs.Name = aws.String(fqdnWithDot(aws.StringValue(rrs.Name)))
+		idx := -1
+		for i, existing := range sets {
+			if aws.StringValue(existing.Name) == aws.StringValue(rrs.Name) && aws.StringValue(existing.Type) == aws.StringValue(rrs.Type) {
+				idx = i
+			}
+		}
+		switch aws.StringValue(change.Action) {
+		case route53.ChangeActionCreate:
+			if idx >= 0 {
+				return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, fmt.Sprintf("Tried to create resource record set %s type %s but it already exists", aws.StringValue(rrs.Name), aws.StringValue(rrs.Type)), nil)
+			}
+			sets = append(sets, rrs)
+		case route53.ChangeActionUpsert:
+			if idx >= 0 {
+				sets[idx] = rrs
+			} else {
+				sets = append(sets, rrs)
+			}
+		case route53.ChangeActionDelete:
+			if idx < 0 {
+				return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, fmt.Sprintf("Tried to delete resource record set %s type %s but it was not found", aws.StringValue(rrs.Name), aws.StringValue(rrs.Type)), nil)
+			}
+			sets = append(sets[:idx], sets[idx+1:]...)
+		default:
+			return nil, awserr.New(route53.ErrCodeInvalidInput, "unknown change action: "+aws.StringValue(change.Action), nil)
+		}
+	}
+	f.State.RecordSets[zoneID] = sets
+
+	n := f.State.nextID()
+	if err := f.State.persist(); err != nil {
+		return nil, err
+	}
+	return &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &route53.ChangeInfo{
+			Id:          aws.String(fmt.Sprintf("/change/C%012d", n)),
+			Status:      aws.String(route53.ChangeStatusInsync),
+			SubmittedAt: aws.Time(time.Now().UTC()),
+		},
+	}, nil
+}
+
+// ListResourceRecordSets - a zone's record sets in name/type order, starting from the given name and type
+func (f *FakeRoute53) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("ListResourceRecordSets"); err != nil {
+		return nil, err
+	}
+
+	sets := append([]*route53.ResourceRecordSet(nil), f.State.RecordSets[aws.StringValue(input.HostedZoneId)]...)
+	sort.Slice(sets, func(i, j int) bool {
+		if aws.StringValue(sets[i].Name) != aws.StringValue(sets[j].Name) {
+			return aws.StringValue(sets[i].Name) < aws.StringValue(sets[j].Name)
+		}
+		return aws.StringValue(sets[i].Type) < aws.StringValue(sets[j].Type)
+	})
+
+	max := len(sets)
+	if input.MaxItems != nil {
+		fmt.Sscanf(aws.StringValue(input.MaxItems), "%d", &max)
+	}
+	startName := strings.ToLower(fqdnWithDot(aws.StringValue(input.StartRecordName)))
+	out := &route53.ListResourceRecordSetsOutput{MaxItems: input.MaxItems, IsTruncated: aws.Bool(false)}
+	for _, rrs := range sets {
+		name := strings.ToLower(aws.StringValue(rrs.Name))
+		if input.StartRecordName != nil && (name < startName || (name == startName && aws.StringValue(rrs.Type) < aws.StringValue(input.StartRecordType))) {
+			continue
+		}
+		if len(out.ResourceRecordSets) == max {
+			out.IsTruncated = aws.Bool(true)
+			out.NextRecordName = rrs.Name
+			out.NextRecordType = rrs.Type
+			break
+		}
+		out.ResourceRecordSets = append(out.ResourceRecordSets, awsutil.CopyOf(rrs).(*route53.ResourceRecordSet))
+	}
+	return out, nil
+}
+
+// GetHostedZone - look up a registered hosted zone
+func (f *FakeRoute53) GetHostedZone(input *route53.GetHostedZoneInput) (*route53.GetHostedZoneOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("GetHostedZone"); err != nil {
+		return nil, err
+	}
+
+	zone := f.State.findHostedZone(aws.StringValue(input.Id))
+	if zone == nil {
+		return nil, awserr.New(route53.ErrCodeNoSuchHostedZone, fmt.Sprintf("No hosted zone found with ID: %s", aws.StringValue(input.Id)), nil)
+	}
+	return &route53.GetHostedZoneOutput{HostedZone: awsutil.CopyOf(zone).(*route53.HostedZone)}, nil
+}
+
+// FakeCallerARN - the default identity the fake STS reports
+const FakeCallerARN = "arn:aws:iam::000000000000:user/terrafire-sim"
+
+// FakeSTS - STSAPI implementation backed by a FakeState
+type FakeSTS struct {
+	State *FakeState
+}
+
+// NewFakeSTS - create a fake STS service, a nil state starts empty
+func NewFakeSTS(state *FakeState) *FakeSTS {
+	if state == nil {
+		state = NewFakeState()
+	}
+	return &FakeSTS{State: state}
+}
+
+// GetCallerIdentity - the state's CallerARN, or FakeCallerARN
+func (f *FakeSTS) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("GetCallerIdentity"); err != nil {
+		return nil, err
+	}
+
+	arn := f.State.CallerARN
+	if arn == "" {
+		arn = FakeCallerARN
+	}
+	out := &sts.GetCallerIdentityOutput{Arn: aws.String(arn), UserId: aws.String("AIDAFAKESIMUSER")}
+	if parts := strings.Split(arn, ":"); len(parts) > 4 {
+		out.Account = aws.String(parts[4])
+	}
+	return out, nil
+}
+
+// FakeIAM - IAMAPI implementation backed by a FakeState
+type FakeIAM struct {
+	State *FakeState
+}
+
+// NewFakeIAM - create a fake IAM service, a nil state starts empty
+func NewFakeIAM(state *FakeState) *FakeIAM {
+	if state == nil {
+		state = NewFakeState()
+	}
+	return &FakeIAM{State: state}
+}
+
+// GetInstanceProfile - look up a registered instance profile by name
+func (f *FakeIAM) GetInstanceProfile(input *iam.GetInstanceProfileInput) (*iam.GetInstanceProfileOutput, error) {
+	f.State.mu.Lock()
+	defer f.State.mu.Unlock()
+
+	if err := f.State.failure("GetInstanceProfile"); err != nil {
+		return nil, err
+	}
+
+	profile := f.State.findInstanceProfile(aws.StringValue(input.InstanceProfileName))
+	if profile == nil {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, fmt.Sprintf("Instance Profile %s cannot be found.", aws.StringValue(input.InstanceProfileName)), nil)
+	}
+	return &iam.GetInstanceProfileOutput{InstanceProfile: awsutil.CopyOf(profile).(*iam.InstanceProfile)}, nil
+}
+
+// util - check an instance against describe filters, values within a filter are OR'd
+func fakeInstanceMatches(inst *ec2.Instance, filters []*ec2.Filter) bool {
+	for _, flt := range filters {
+		name := aws.StringValue(flt.Name)
+		var actual string
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			actual = GetInstanceTag(strings.TrimPrefix(name, "tag:"), *inst)
+		case name == "instance-id":
+			actual = aws.StringValue(inst.InstanceId)
+		case name == "instance-state-name":
+			actual = aws.StringValue(inst.State.Name)
+		default:
+			return false
+		}
+		if !containsString(aws.StringValueSlice(flt.Values), actual) {
+			return false
+		}
+	}
+	return true
+}
+
+// util - a fake instance profile, in the same account as FakeCallerARN
+func fakeInstanceProfile(name string) *iam.InstanceProfile {
+	return &iam.InstanceProfile{
+		InstanceProfileName: aws.String(name),
+		InstanceProfileId:   aws.String("AIPAFAKE" + strings.ToUpper(name)),
+		Arn:                 aws.String("arn:aws:iam::000000000000:instance-profile/" + name),
+		Path:                aws.String("/"),
+	}
+}
+
+// util - a fake available image
+func fakeImage(imageID, owner, name, architecture string, created time.Time) *ec2.Image {
+	return &ec2.Image{
+		ImageId:      aws.String(imageID),
+		OwnerId:      aws.String(owner),
+		Name:         aws.String(name),
+		Architecture: aws.String(architecture),
+		State:        aws.String(ec2.ImageStateAvailable),
+		CreationDate: aws.String(created.UTC().Format("2006-01-02T15:04:05.000Z")),
+	}
+}
+
+// util - a fake security group
+func fakeSecurityGroup(groupID, name, vpcID string) *ec2.SecurityGroup {
+	return &ec2.SecurityGroup{
+		GroupId:   aws.String(groupID),
+		GroupName: aws.String(name),
+		VpcId:     aws.String(vpcID),
+	}
+}
+
+// util - a fake subnet
+func fakeSubnet(subnetID, zone, vpcID string) *ec2.Subnet {
+	return &ec2.Subnet{
+		SubnetId:         aws.String(subnetID),
+		AvailabilityZone: aws.String(zone),
+		VpcId:            aws.String(vpcID),
+		State:            aws.String(ec2.SubnetStateAvailable),
+	}
+}
+
+// util - check a subnet against describe filters, values within a filter are OR'd
+func fakeSubnetMatches(subnet *ec2.Subnet, filters []*ec2.Filter) bool {
+	for _, flt := range filters {
+		name := aws.StringValue(flt.Name)
+		var actual string
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			actual = fakeTag(subnet.Tags, strings.TrimPrefix(name, "tag:"))
+		case name == "vpc-id":
+			actual = aws.StringValue(subnet.VpcId)
+		case name == "availability-zone":
+			actual = aws.StringValue(subnet.AvailabilityZone)
+		default:
+			return false
+		}
+		if !containsString(aws.StringValueSlice(flt.Values), actual) {
+			return false
+		}
+	}
+	return true
+}
+
+// util - a tag's value, empty if it isn't set
+func fakeTag(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+// util - tags with updates applied over the existing set
+func mergeFakeTags(tags []*ec2.Tag, updates []*ec2.Tag) []*ec2.Tag {
+	for _, upd := range updates {
+		found := false
+		for _, tag := range tags {
+			if aws.StringValue(tag.Key) == aws.StringValue(upd.Key) {
+				tag.Value = upd.Value
+				found = true
+			}
+		}
+		if !found {
+			tags = append(tags, &ec2.Tag{Key: upd.Key, Value: upd.Value})
+		}
+	}
+	return tags
+}
+
+// util - a fake key pair
+func fakeKeyPair(name string) *ec2.KeyPairInfo {
+	return &ec2.KeyPairInfo{
+		KeyName:        aws.String(name),
+		KeyFingerprint: aws.String("00:00:00:00:00:00:00:00:00:00:00:00:00:00:00:00:00:00:00:00"),
+	}
+}
+
+// util - a fake public hosted zone
+func fakeHostedZone(zoneID, name string) *route53.HostedZone {
+	return &route53.HostedZone{
+		Id:              aws.String("/hostedzone/" + strings.TrimPrefix(zoneID, "/hostedzone/")),
+		Name:            aws.String(fqdnWithDot(name)),
+		CallerReference: aws.String(zoneID),
+	}
+}
+
+func fakeAddress(allocationID, publicIP string) *ec2.Address {
+	return &ec2.Address{
+		AllocationId: aws.String(allocationID),
+		PublicIp:     aws.String(publicIP),
+		Domain:       aws.String(ec2.DomainTypeVpc),
+	}
+}
+
+func fakeInstanceState(name string) *ec2.InstanceState {
+	codes := map[string]int64{
+		ec2.InstanceStateNamePending:      0,
+		ec2.InstanceStateNameRunning:      16,
+		ec2.InstanceStateNameShuttingDown: 32,
+		ec2.InstanceStateNameTerminated:   48,
+		ec2.InstanceStateNameStopping:     64,
+		ec2.InstanceStateNameStopped:      80,
+	}
+	return &ec2.InstanceState{Code: aws.Int64(codes[name]), Name: aws.String(name)}
+}
+
+func fqdnWithDot(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
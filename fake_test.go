@@ -0,0 +1,87 @@
+package terrafire
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+func TestFakeEC2RunAndDescribe(t *testing.T) {
+	svc := NewFakeEC2(nil)
+	res, err := svc.RunInstances(&ec2.RunInstancesInput{
+		ImageId: aws.String("ami-1"),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags:         []*ec2.Tag{{Key: aws.String(TagGroup), Value: aws.String("test")}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := aws.StringValue(res.Instances[0].InstanceId)
+
+	out, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{Filters: []*ec2.Filter{
+		{Name: aws.String("tag:" + TagGroup), Values: []*string{aws.String("test")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Reservations) != 1 || aws.StringValue(out.Reservations[0].Instances[0].InstanceId) != id {
+		t.Fatalf("describe by group tag = %v, want only %s", out.Reservations, id)
+	}
+
+	out, err = svc.DescribeInstances(&ec2.DescribeInstancesInput{Filters: []*ec2.Filter{
+		{Name: aws.String("tag:" + TagGroup), Values: []*string{aws.String("other")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Reservations) != 0 {
+		t.Errorf("describe by another group's tag = %v, want nothing", out.Reservations)
+	}
+}
+
+func TestFakeEC2UnknownInstance(t *testing.T) {
+	svc := NewFakeEC2(nil)
+	_, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String("i-nope")}})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "InvalidInstanceID.NotFound" {
+		t.Errorf("terminate unknown instance error = %v, want InvalidInstanceID.NotFound", err)
+	}
+}
+
+func TestFakeRoute53UpsertAndDelete(t *testing.T) {
+	svc := NewFakeRoute53(nil)
+	change := func(action string) error {
+		params := createRoute53Params(action, "A", "Z1", "web1.example.com", "10.0.0.1", 60)
+		_, err := svc.ChangeResourceRecordSets(params)
+		return err
+	}
+	if err := change(route53.ChangeActionUpsert); err != nil {
+		t.Fatal(err)
+	}
+	if sets := svc.State.RecordSets["Z1"]; len(sets) != 1 || aws.StringValue(sets[0].Name) != "web1.example.com." {
+		t.Fatalf("record sets = %v, want web1.example.com.", sets)
+	}
+	if err := change(route53.ChangeActionDelete); err != nil {
+		t.Fatal(err)
+	}
+	if err := change(route53.ChangeActionDelete); err == nil {
+		t.Error("deleting a record that is already gone succeeded")
+	}
+}
+
+func TestFakeEC2Failures(t *testing.T) {
+	state := NewFakeState()
+	svc := NewFakeEC2(state)
+	state.Fail("RunInstances", "no capacity")
+	if _, err := svc.RunInstances(&ec2.RunInstancesInput{}); err == nil {
+		t.Fatal("RunInstances succeeded with an injected failure")
+	}
+	state.Fail("RunInstances", "")
+	if _, err := svc.RunInstances(&ec2.RunInstancesInput{}); err != nil {
+		t.Errorf("RunInstances after clearing the failure: %s", err)
+	}
+}
@@ -0,0 +1,1088 @@
+package terrafire
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// PlanKind - whether a plan creates or destroys a group
+type PlanKind string
+
+// PlanAction - what a plan will do (or refuses to do) with a single instance
+type PlanAction string
+
+// PlanErrorCode - the kind of problem found while planning
+type PlanErrorCode string
+
+const (
+	PlanKindApply   PlanKind = "apply"
+	PlanKindDestroy PlanKind = "destroy"
+)
+
+const (
+	PlanActionCreate         PlanAction = "create"          // configured, nothing live, will be launched
+	PlanActionConflict       PlanAction = "conflict"        // configured, but a live instance already has the name
+	PlanActionSkipTerminated PlanAction = "skip-terminated" // live but terminated, left alone
+	PlanActionDestroy        PlanAction = "destroy"         // configured and live, will be terminated
+	PlanActionOrphan         PlanAction = "orphan"          // live in the group, but not configured
+	PlanActionExisting       PlanAction = "existing"        // configured and already running, resumed rather than launched
+)
+
+const (
+	PlanErrInstanceExists PlanErrorCode = "instance-exists"
+	PlanErrNotConfigured  PlanErrorCode = "not-configured"
+	PlanErrNotFound       PlanErrorCode = "not-found"
+	PlanErrUnknownTier    PlanErrorCode = "unknown-tier"
+	PlanErrUnknownName    PlanErrorCode = "unknown-instance"
+	PlanErrAmbiguous      PlanErrorCode = "ambiguous"
+	PlanErrReservedTag    PlanErrorCode = "reserved-tag"
+	PlanErrTierMismatch   PlanErrorCode = "tier-mismatch"
+	PlanErrZoneMismatch   PlanErrorCode = "zone-mismatch"
+	PlanErrNoSubnet       PlanErrorCode = "subnet-not-found"
+	PlanErrBadSubnet      PlanErrorCode = "bad-subnet"
+	PlanErrBadVolume      PlanErrorCode = "bad-volume"
+	PlanErrNoProfile      PlanErrorCode = "instance-profile-not-found"
+	PlanErrBadMarket      PlanErrorCode = "bad-market"
+	PlanErrNoSecGroup     PlanErrorCode = "security-group-not-found"
+	PlanErrSecGroupVPC    PlanErrorCode = "security-group-wrong-vpc"
+	PlanErrNoAMI          PlanErrorCode = "ami-not-found"
+	PlanErrBadAMI         PlanErrorCode = "bad-ami"
+	PlanErrNoKeyPair      PlanErrorCode = "key-pair-not-found"
+	PlanErrNoAddress      PlanErrorCode = "elastic-ip-not-found"
+	PlanErrAddressInUse   PlanErrorCode = "elastic-ip-in-use"
+	PlanErrNoHostedZone   PlanErrorCode = "hosted-zone-not-found"
+	PlanErrUserData       PlanErrorCode = "bad-user-data"
+	PlanErrDryRun         PlanErrorCode = "dry-run-failed"
+)
+
+// ErrEmptyTier - every tier in a group must have at least one instance
+var ErrEmptyTier = errors.New("a tier must contain at least one instance")
+
+// Plan - everything that will be created or destroyed for a group, a plan with errors must not be run
+type Plan struct {
+	Kind       PlanKind
+	Group      GroupConfig // as launched, names the config gives for aws resources are resolved to ids
+	Scope      DestroyScope
+	Instances  []PlanInstance
+	Records    []PlanRecord
+	Errors     []PlanError
+	Resume     bool              // made with PlanOptions.Resume
+	ConfigHash string            // HashGroupConfig of the group the plan was made from
+	UserData   map[string]string // optional, see UserDataHashes
+	Snapshot   []LiveInstance    // the live group instances the plan was made from
+}
+
+// PlanOptions - optional behaviour for CreatePlan
+type PlanOptions struct {
+	Resume bool // treat running/pending instances with a configured name as already launched instead of a conflict
+}
+
+// DestroyScope - limits a destroy plan to a tier and/or some instances, the zero value is the whole group
+type DestroyScope struct {
+	Tier      string
+	Instances []string
+}
+
+// WholeGroup - true if nothing is filtered out
+func (ds DestroyScope) WholeGroup() bool {
+	return ds.Tier == "" && len(ds.Instances) == 0
+}
+
+func (ds DestroyScope) String() string {
+	if ds.WholeGroup() {
+		return "whole group"
+	}
+	s := ""
+	if ds.Tier != "" {
+		s = "tier: " + ds.Tier
+	}
+	if len(ds.Instances) > 0 {
+		if s != "" {
+			s = s + ", "
+		}
+		s = s + "instances: " + strings.Join(ds.Instances, ",")
+	}
+	return s
+}
+
+// Selects - true if the configured instance in the given tier is within the scope
+func (ds DestroyScope) Selects(tier, name string) bool {
+	if ds.Tier != "" && ds.Tier != tier {
+		return false
+	}
+	return len(ds.Instances) == 0 || containsString(ds.Instances, name)
+}
+
+// util - errors for a scope that names tiers or instances that aren't configured, a tier only in the live state is fine
+func (ds DestroyScope) validate(group GroupConfig, liveTiers map[string]bool) []PlanError {
+	errs := make([]PlanError, 0)
+	if ds.Tier != "" {
+		found := liveTiers[ds.Tier]
+		for _, tier := range group.Tiers {
+			found = found || tier.Name == ds.Tier
+		}
+		if !found {
+			errs = append(errs, PlanError{Code: PlanErrUnknownTier, Tier: ds.Tier})
+		}
+	}
+	for _, name := range ds.Instances {
+		found := false
+		for _, tier := range group.Tiers {
+			found = found || (tier.GetInstance(name) != nil && ds.Selects(tier.Name, name))
+		}
+		if !found {
+			errs = append(errs, PlanError{Code: PlanErrUnknownName, Tier: ds.Tier, Name: name})
+		}
+	}
+	return errs
+}
+
+// PlanInstance - the planned action for a single instance
+type PlanInstance struct {
+	Action     PlanAction
+	Tier       string
+	Name       string
+	InstanceID string
+	State      string
+}
+
+// PlanRecord - a live route53 record set belonging to a planned instance
+type PlanRecord struct {
+	Tier      string
+	Instance  string
+	ZoneID    string
+	RecordSet *route53.ResourceRecordSet
+}
+
+// Name - the record's fully qualified name
+func (pr PlanRecord) Name() string {
+	return aws.StringValue(pr.RecordSet.Name)
+}
+
+// PlanError - a single problem found while planning
+type PlanError struct {
+	Code       PlanErrorCode
+	Tier       string
+	Name       string
+	InstanceID string
+	Detail     string // extra context for some codes, e.g. the offending tag key
+}
+
+func (pe PlanError) Error() string {
+	switch pe.Code {
+	case PlanErrInstanceExists:
+		return "Instance already exists: " + pe.Name
+	case PlanErrNotConfigured:
+		return "Instance: \"" + pe.Name + "\" exists but is not configured!!"
+	case PlanErrNotFound:
+		return "Instance: \"" + pe.Name + "\" does not exist!!"
+	case PlanErrUnknownTier:
+		return "Tier: \"" + pe.Tier + "\" is not configured!!"
+	case PlanErrUnknownName:
+		if pe.Tier != "" {
+			return "Instance: \"" + pe.Name + "\" is not configured in tier \"" + pe.Tier + "\"!!"
+		}
+		return "Instance: \"" + pe.Name + "\" is not configured!!"
+	case PlanErrAmbiguous:
+		return "Instance: \"" + pe.Name + "\" matches more than one live instance!!"
+	case PlanErrReservedTag:
+		where := "Group"
+		switch {
+		case pe.Name != "":
+			where = "Instance: \"" + pe.Name + "\""
+		case pe.Tier != "":
+			where = "Tier: \"" + pe.Tier + "\""
+		}
+		return where + " sets tag \"" + pe.Detail + "\" which is reserved by terrafire!!"
+	case PlanErrTierMismatch:
+		return "Instance: \"" + pe.Name + "\" is configured in tier \"" + pe.Tier + "\" but is live in tier \"" + pe.Detail + "\"!!"
+	case PlanErrZoneMismatch:
+		return "Instance: \"" + pe.Name + "\" zone doesn't match its subnet, " + pe.Detail + "!!"
+	case PlanErrNoSubnet:
+		return "Instance: \"" + pe.Name + "\" subnet \"" + pe.Detail + "\" does not exist!!"
+	case PlanErrBadSubnet:
+		return "Instance: \"" + pe.Name + "\" has a bad subnet, " + pe.Detail + "!!"
+	case PlanErrBadVolume:
+		return "Instance: \"" + pe.Name + "\" has a bad volume, " + pe.Detail + "!!"
+	case PlanErrNoProfile:
+		return "Instance: \"" + pe.Name + "\" instance profile \"" + pe.Detail + "\" does not exist!!"
+	case PlanErrBadMarket:
+		return "Instance: \"" + pe.Name + "\" has a bad market, " + pe.Detail + "!!"
+	case PlanErrNoSecGroup, PlanErrSecGroupVPC:
+		return "Instance: \"" + pe.Name + "\" security group " + pe.Detail + "!!"
+	case PlanErrNoAMI:
+		return "Instance: \"" + pe.Name + "\" no AMI matches " + pe.Detail + "!!"
+	case PlanErrBadAMI:
+		return "Instance: \"" + pe.Name + "\" has a bad AMI, " + pe.Detail + "!!"
+	case PlanErrNoKeyPair:
+		return "Instance: \"" + pe.Name + "\" key pair \"" + pe.Detail + "\" does not exist!!"
+	case PlanErrNoAddress:
+		return "Instance: \"" + pe.Name + "\" elastic IP \"" + pe.Detail + "\" does not exist!!"
+	case PlanErrAddressInUse:
+		return "Instance: \"" + pe.Name + "\" elastic IP " + pe.Detail + "!!"
+	case PlanErrNoHostedZone:
+		return "Instance: \"" + pe.Name + "\" route53 hosted zone \"" + pe.Detail + "\" does not exist!!"
+	case PlanErrUserData:
+		return "Instance: \"" + pe.Name + "\" user data doesn't render, " + pe.Detail + "!!"
+	case PlanErrDryRun:
+		return "Tier: \"" + pe.Tier + "\" launch of \"" + pe.Name + "\" would fail, " + pe.Detail + "!!"
+	}
+	return fmt.Sprintf("Instance: \"%s\" %s", pe.Name, pe.Code)
+}
+
+// OK - true if the plan has no errors and can be run
+func (p Plan) OK() bool {
+	return len(p.Errors) == 0
+}
+
+// InstancesWithAction - all planned instances with the given action, in plan order
+func (p Plan) InstancesWithAction(action PlanAction) []PlanInstance {
+	res := make([]PlanInstance, 0)
+	for _, pi := range p.Instances {
+		if pi.Action == action {
+			res = append(res, pi)
+		}
+	}
+	return res
+}
+
+// InstanceIDs - ids of all the instances the plan will destroy
+func (p Plan) InstanceIDs() []string {
+	ids := make([]string, 0)
+	for _, pi := range p.InstancesWithAction(PlanActionDestroy) {
+		ids = append(ids, pi.InstanceID)
+	}
+	return ids
+}
+
+// TierToLaunch - the tier with only the instances the plan will create
+func (p Plan) TierToLaunch(tier EC2InstanceTier) EC2InstanceTier {
+	launch := tier
+	launch.Instances = make([]EC2Instance, 0, len(tier.Instances))
+	for _, pi := range p.InstancesWithAction(PlanActionCreate) {
+		if pi.Tier != tier.Name {
+			continue
+		}
+		if inst := tier.GetInstance(pi.Name); inst != nil {
+			launch.Instances = append(launch.Instances, *inst)
+		}
+	}
+	return launch
+}
+
+// TierExisting - the instances in a tier the plan resumes rather than launches
+func (p Plan) TierExisting(tier string) []PlanInstance {
+	res := make([]PlanInstance, 0)
+	for _, pi := range p.InstancesWithAction(PlanActionExisting) {
+		if pi.Tier == tier {
+			res = append(res, pi)
+		}
+	}
+	return res
+}
+
+// DestroyOrder - the tiers a destroy plan has work in, in the order it runs them (the reverse of the configured order),
+// tiers that are only known from live tags aren't part of that order so they go first
+func (p Plan) DestroyOrder() []string {
+	tiers := make([]string, 0, len(p.Group.Tiers))
+	configured := make(map[string]bool)
+	for _, tier := range p.Group.Tiers {
+		configured[tier.Name] = true
+	}
+	for _, pi := range p.InstancesWithAction(PlanActionDestroy) {
+		if !configured[pi.Tier] && !containsString(tiers, pi.Tier) {
+			tiers = append(tiers, pi.Tier)
+		}
+	}
+	sort.Strings(tiers)
+	for i := len(p.Group.Tiers) - 1; i >= 0; i-- {
+		name := p.Group.Tiers[i].Name
+		if len(p.TierInstanceIDs(name)) > 0 || len(p.TierRecords(name)) > 0 {
+			tiers = append(tiers, name)
+		}
+	}
+	return tiers
+}
+
+// TierInstanceIDs - ids of the instances the plan will destroy in a single tier
+func (p Plan) TierInstanceIDs(tier string) []string {
+	ids := make([]string, 0)
+	for _, pi := range p.InstancesWithAction(PlanActionDestroy) {
+		if pi.Tier == tier {
+			ids = append(ids, pi.InstanceID)
+		}
+	}
+	return ids
+}
+
+// TierRecords - route53 records the plan will delete in a single tier
+func (p Plan) TierRecords(tier string) []PlanRecord {
+	recs := make([]PlanRecord, 0)
+	for _, rec := range p.Records {
+		if rec.Tier == tier {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+// CreatePlan - create the plan of attack for instantiating all the things
+func CreatePlan(base BaseConfig, group GroupConfig, svcs Services, opts PlanOptions) (Plan, error) {
+
+	plan := Plan{Kind: PlanKindApply, Group: group, Resume: opts.Resume}
+	hash, err := HashGroupConfig(group)
+	if err != nil {
+		return plan, err
+	}
+	plan.ConfigHash = hash
+	instances, tiers, err := gatherPlanData(group, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Snapshot = LiveInstances(group, instances)
+	plan.Errors = append(plan.Errors, validateTags(group)...)
+	plan.Errors = append(plan.Errors, validateVolumes(group)...)
+	plan.Errors = append(plan.Errors, validateMarkets(group)...)
+	// the plan launches into subnet ids, whatever the config calls them
+	resolved, subnets, subnetErrs, err := resolveSubnets(group, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Group = resolved
+	plan.Errors = append(plan.Errors, subnetErrs...)
+	plan.Errors = append(plan.Errors, checkPlacement(plan.Group, subnets)...)
+
+	// with security group ids
+	resolved, sgErrs, err := resolveSecurityGroups(plan.Group, subnets, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Group = resolved
+	plan.Errors = append(plan.Errors, sgErrs...)
+
+	// and with AMI ids, pinned to the newest image matching each filter right now
+	resolved, amiErrs, err := resolveAMIs(plan.Group, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Group = resolved
+	plan.Errors = append(plan.Errors, amiErrs...)
+	profileErrs, err := checkInstanceProfiles(group, svcs.IAM)
+	if err != nil {
+		return plan, err
+	}
+	plan.Errors = append(plan.Errors, profileErrs...)
+
+	// everything else the instances refer to must exist too
+	imageErrs, err := checkImages(plan.Group, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Errors = append(plan.Errors, imageErrs...)
+	keyErrs, err := checkKeyPairs(group, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Errors = append(plan.Errors, keyErrs...)
+	addrErrs, err := checkAddresses(group, instances, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Errors = append(plan.Errors, addrErrs...)
+	zoneErrs, err := checkHostedZones(group, svcs.Route53)
+	if err != nil {
+		return plan, err
+	}
+	plan.Errors = append(plan.Errors, zoneErrs...)
+
+	// index the live instances by name, terminated ones don't count
+	live := make(map[string]ec2.Instance)
+	count := make(map[string]int)
+	for _, inst := range instances {
+		tagName := GetInstanceTag(TagName, inst)
+		if tagName == "" {
+			continue
+		}
+		if stateClass(aws.StringValue(inst.State.Name)) == stateTerminated {
+			if _, configured := tiers[tagName]; configured {
+				plan.Instances = append(plan.Instances, planInstance(PlanActionSkipTerminated, instanceTier(inst, tiers), inst))
+			}
+			continue
+		}
+		live[tagName] = inst
+		count[tagName]++
+	}
+
+	// every configured instance is either created, resumed or conflicts with a live one
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			liveInst, exists := live[inst.Name]
+			switch {
+			case !exists:
+				plan.Instances = append(plan.Instances, PlanInstance{Action: PlanActionCreate, Tier: tier.Name, Name: inst.Name})
+			case opts.Resume && count[inst.Name] > 1:
+				plan.Instances = append(plan.Instances, planInstance(PlanActionConflict, tier.Name, liveInst))
+				plan.Errors = append(plan.Errors, PlanError{Code: PlanErrAmbiguous, Tier: tier.Name, Name: inst.Name})
+			case opts.Resume && instanceTier(liveInst, tiers) != tier.Name:
+				plan.Instances = append(plan.Instances, planInstance(PlanActionConflict, tier.Name, liveInst))
+				plan.Errors = append(plan.Errors, PlanError{Code: PlanErrTierMismatch, Tier: tier.Name, Name: inst.Name, InstanceID: aws.StringValue(liveInst.InstanceId), Detail: instanceTier(liveInst, tiers)})
+			case opts.Resume && resumable(liveInst):
+				plan.Instances = append(plan.Instances, planInstance(PlanActionExisting, tier.Name, liveInst))
+			default:
+				plan.Instances = append(plan.Instances, planInstance(PlanActionConflict, tier.Name, liveInst))
+				plan.Errors = append(plan.Errors, PlanError{Code: PlanErrInstanceExists, Tier: tier.Name, Name: inst.Name, InstanceID: aws.StringValue(liveInst.InstanceId)})
+			}
+		}
+	}
+
+	// finally, when nothing else is wrong, check EC2 would actually let us launch
+	if plan.OK() {
+		dryRunErrs, err := dryRunLaunches(plan, base, svcs.EC2)
+		if err != nil {
+			return plan, err
+		}
+		plan.Errors = append(plan.Errors, dryRunErrs...)
+	}
+	return plan, nil
+}
+
+// CreateDestroyPlan - create the plan of attack for DESTROYING all the things (or just those in scope), instances and their route53 records
+func CreateDestroyPlan(group GroupConfig, svcs Services, scope DestroyScope) (Plan, error) {
+
+	plan := Plan{Kind: PlanKindDestroy, Group: group, Scope: scope}
+	hash, err := HashGroupConfig(group)
+	if err != nil {
+		return plan, err
+	}
+	plan.ConfigHash = hash
+	instances, tiers, err := gatherPlanData(group, svcs.EC2)
+	if err != nil {
+		return plan, err
+	}
+	plan.Snapshot = LiveInstances(group, instances)
+	liveTiers := make(map[string]bool)
+	liveTier := make(map[string]string)
+	for _, inst := range instances {
+		if tier := GetInstanceTag(TagTier, inst); tier != "" {
+			liveTiers[tier] = true
+		}
+		liveTier[GetInstanceTag(TagName, inst)] = instanceTier(inst, tiers)
+	}
+	plan.Errors = append(plan.Errors, scope.validate(group, liveTiers)...)
+
+	// a configured instance belongs to the tier it is live in, if it is live
+	tierOf := func(configured, name string) string {
+		if tier, ok := liveTier[name]; ok {
+			return tier
+		}
+		return configured
+	}
+
+	// check that our configuration matches actual AWS instances, unconfigured ones matter if they are in scope,
+	// the tier comes from the live instance's tier tag where it has one
+	existing := make(map[string]bool, len(instances))
+	destroying := make(map[string]ec2.Instance, len(instances))
+	running := make(map[string]int, len(instances))
+	for _, inst := range instances {
+		tagName := GetInstanceTag(TagName, inst)
+		if tagName == "" {
+			continue
+		}
+		_, configured := tiers[tagName]
+		tier := instanceTier(inst, tiers)
+		switch {
+		case !configured:
+			if scope.Selects(tier, tagName) {
+				plan.Instances = append(plan.Instances, planInstance(PlanActionOrphan, tier, inst))
+				plan.Errors = append(plan.Errors, PlanError{Code: PlanErrNotConfigured, Tier: tier, Name: tagName, InstanceID: aws.StringValue(inst.InstanceId)})
+			}
+		case !scope.Selects(tier, tagName):
+			continue
+		case stateClass(aws.StringValue(inst.State.Name)) == stateTerminated:
+			existing[tagName] = true
+			plan.Instances = append(plan.Instances, planInstance(PlanActionSkipTerminated, tier, inst))
+		default:
+			existing[tagName] = true
+			running[tagName]++
+			destroying[tagName] = inst
+			plan.Instances = append(plan.Instances, planInstance(PlanActionDestroy, tier, inst))
+		}
+	}
+
+	// check that our configuration doesn't try to destroy non-existing nodes, or pick between several in a scoped destroy
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			if !scope.Selects(tierOf(tier.Name, inst.Name), inst.Name) {
+				continue
+			}
+			if !existing[inst.Name] {
+				plan.Errors = append(plan.Errors, PlanError{Code: PlanErrNotFound, Tier: tier.Name, Name: inst.Name})
+			}
+			if !scope.WholeGroup() && running[inst.Name] > 1 {
+				plan.Errors = append(plan.Errors, PlanError{Code: PlanErrAmbiguous, Tier: tier.Name, Name: inst.Name})
+			}
+		}
+	}
+
+	// any route53 records pointing at the selected instances being destroyed go too, in the same tier as their
+	// instance, a record someone has pointed elsewhere is left alone
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			liveInst, ok := destroying[inst.Name]
+			if !ok {
+				continue
+			}
+			rrs, err := GetRoute53Record(svcs.Route53, inst)
+			if err != nil {
+				return plan, err
+			}
+			if rrs != nil && recordPointsAt(rrs, instanceAddresses(liveInst)) {
+				plan.Records = append(plan.Records, PlanRecord{Tier: tierOf(tier.Name, inst.Name), Instance: inst.Name, ZoneID: inst.Route53.ZoneID, RecordSet: rrs})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// util - the addresses and dns names a live instance can be reached by, an associated elastic IP is its public IP
+func instanceAddresses(liveInst ec2.Instance) []string {
+	return []string{
+		aws.StringValue(liveInst.PublicIpAddress),
+		aws.StringValue(liveInst.PublicDnsName),
+		aws.StringValue(liveInst.PrivateIpAddress),
+		aws.StringValue(liveInst.PrivateDnsName),
+	}
+}
+
+// util - true if every value of a record set is one of the addresses, alias records never are
+func recordPointsAt(rrs *route53.ResourceRecordSet, addrs []string) bool {
+	if len(rrs.ResourceRecords) == 0 {
+		return false
+	}
+	for _, rr := range rrs.ResourceRecords {
+		value := strings.TrimSuffix(aws.StringValue(rr.Value), ".")
+		found := false
+		for _, addr := range addrs {
+			found = found || (addr != "" && strings.EqualFold(value, strings.TrimSuffix(addr, ".")))
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// util - gather up the live instance info and a map of configured instance names to their tier
+func gatherPlanData(group GroupConfig, svc EC2API) ([]ec2.Instance, map[string]string, error) {
+
+	// get existing instances in group
+	instances, err := GetGroupInstances(group, svc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// check for empty tiers (illegal)
+	for _, tier := range group.Tiers {
+		if len(tier.Instances) < 1 {
+			return nil, nil, ErrEmptyTier
+		}
+	}
+
+	// create a map of configured instance names
+	names := make(map[string]string)
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			names[inst.Name] = tier.Name
+		}
+	}
+	return instances, names, nil
+}
+
+// util - errors for any user tags that try to override terrafire's own
+func validateTags(group GroupConfig) []PlanError {
+	errs := make([]PlanError, 0)
+	check := func(tags map[string]string, tier, name string) {
+		keys := make([]string, 0)
+		for key := range tags {
+			if containsString(ReservedTags, key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			errs = append(errs, PlanError{Code: PlanErrReservedTag, Tier: tier, Name: name, Detail: key})
+		}
+	}
+	check(group.Tags, "", "")
+	for _, tier := range group.Tiers {
+		check(tier.Tags, tier.Name, "")
+		for _, inst := range tier.Instances {
+			check(inst.Tags, tier.Name, inst.Name)
+		}
+	}
+	return errs
+}
+
+// util - errors for volumes EC2 would refuse, so they're caught before anything is launched
+func validateVolumes(group GroupConfig) []PlanError {
+	errs := make([]PlanError, 0)
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			devices := make(map[string]bool)
+			for _, vol := range inst.Volumes {
+				problem := ""
+				switch {
+				case vol.Device == "":
+					problem = "every volume needs a device"
+				case devices[vol.Device]:
+					problem = fmt.Sprintf("device %s is used more than once", vol.Device)
+				case vol.Throughput > 0 && vol.Type != ec2.VolumeTypeGp3:
+					problem = fmt.Sprintf("device %s sets throughput, which is only for gp3", vol.Device)
+				case vol.IOPS > 0 && vol.Type != ec2.VolumeTypeGp3 && vol.Type != ec2.VolumeTypeIo1 && vol.Type != ec2.VolumeTypeIo2:
+					problem = fmt.Sprintf("device %s sets iops, which is only for gp3, io1 and io2", vol.Device)
+				case vol.KMSKeyID != "" && !vol.Encrypted:
+					problem = fmt.Sprintf("device %s sets a kms key but isn't encrypted", vol.Device)
+				}
+				if problem != "" {
+					errs = append(errs, PlanError{Code: PlanErrBadVolume, Tier: tier.Name, Name: inst.Name, Detail: problem})
+				}
+				devices[vol.Device] = true
+			}
+		}
+	}
+	return errs
+}
+
+// util - errors for unknown markets or spot interruption behaviours
+func validateMarkets(group GroupConfig) []PlanError {
+	errs := make([]PlanError, 0)
+	for _, tier := range group.Tiers {
+		rc := RunConfig{Group: group, Tier: tier}
+		for _, inst := range tier.Instances {
+			market, spot := rc.InstanceMarket(inst)
+			problem := ""
+			switch {
+			case market != MarketOnDemand && market != MarketSpot:
+				problem = fmt.Sprintf("market \"%s\" must be %s or %s", market, MarketOnDemand, MarketSpot)
+			case spot.Interruption != "" && !containsString(ec2.InstanceInterruptionBehavior_Values(), spot.Interruption):
+				problem = fmt.Sprintf("spot interruption \"%s\" must be one of %s", spot.Interruption, strings.Join(ec2.InstanceInterruptionBehavior_Values(), ", "))
+			}
+			if problem != "" {
+				errs = append(errs, PlanError{Code: PlanErrBadMarket, Tier: tier.Name, Name: inst.Name, Detail: problem})
+			}
+		}
+	}
+	return errs
+}
+
+// util - a copy of the group with every subnet resolved to its id, plus the subnets by id, with errors for subnets that
+// don't exist and selectors that match none or several, each id or selector (and zone) is only looked up once
+func resolveSubnets(group GroupConfig, svc EC2API) (GroupConfig, map[string]*ec2.Subnet, []PlanError, error) {
+	errs := make([]PlanError, 0)
+	subnets := make(map[string]*ec2.Subnet)
+	cache := make(map[string][]*ec2.Subnet)
+	resolved := group
+	resolved.Tiers = make([]EC2InstanceTier, 0, len(group.Tiers))
+	for _, tier := range group.Tiers {
+		rt := tier
+		rt.Instances = make([]EC2Instance, 0, len(tier.Instances))
+		for _, inst := range tier.Instances {
+			sel := inst.Subnet
+			if sel.IsZero() {
+				rt.Instances = append(rt.Instances, inst)
+				continue
+			}
+			if sel.ID != "" && sel.IsSelector() {
+				errs = append(errs, PlanError{Code: PlanErrBadSubnet, Tier: tier.Name, Name: inst.Name, Detail: "set either an id or a selector, not both"})
+				rt.Instances = append(rt.Instances, inst)
+				continue
+			}
+			key := sel.String()
+			if sel.IsSelector() && sel.Zone == "" {
+				key = key + ", zone: " + inst.Zone
+			}
+			matches, looked := cache[key]
+			if !looked {
+				if sel.IsSelector() {
+					found, err := FindSubnets(svc, sel, inst.Zone)
+					if err != nil {
+						return group, nil, nil, err
+					}
+					matches = found
+				} else {
+					subnet, err := GetSubnet(svc, sel.ID)
+					if err != nil {
+						return group, nil, nil, err
+					}
+					if subnet != nil {
+						matches = []*ec2.Subnet{subnet}
+					}
+				}
+				cache[key] = matches
+			}
+			switch len(matches) {
+			case 0:
+				errs = append(errs, PlanError{Code: PlanErrNoSubnet, Tier: tier.Name, Name: inst.Name, Detail: key})
+			case 1:
+				inst.Subnet.ID = aws.StringValue(matches[0].SubnetId)
+				subnets[inst.Subnet.ID] = matches[0]
+			default:
+				ids := make([]string, 0, len(matches))
+				for _, subnet := range matches {
+					ids = append(ids, aws.StringValue(subnet.SubnetId))
+				}
+				errs = append(errs, PlanError{Code: PlanErrBadSubnet, Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("\"%s\" matches %d subnets (%s)", key, len(matches), strings.Join(ids, ", "))})
+			}
+			rt.Instances = append(rt.Instances, inst)
+		}
+		resolved.Tiers = append(resolved.Tiers, rt)
+	}
+	return resolved, subnets, errs, nil
+}
+
+// util - errors for instances whose zone isn't the one their subnet is in
+func checkPlacement(group GroupConfig, subnets map[string]*ec2.Subnet) []PlanError {
+	errs := make([]PlanError, 0)
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			subnet := subnets[inst.Subnet.ID]
+			if inst.Zone == "" || subnet == nil {
+				continue
+			}
+			if aws.StringValue(subnet.AvailabilityZone) != inst.Zone {
+				detail := fmt.Sprintf("zone \"%s\" but subnet \"%s\" is in \"%s\"", inst.Zone, inst.Subnet.ID, aws.StringValue(subnet.AvailabilityZone))
+				errs = append(errs, PlanError{Code: PlanErrZoneMismatch, Tier: tier.Name, Name: inst.Name, Detail: detail})
+			}
+		}
+	}
+	return errs
+}
+
+// util - a copy of the group with every security group name resolved to its id in the instance's subnet's vpc, with
+// errors for groups that don't exist or are in another vpc, and for names on instances without a known subnet
+func resolveSecurityGroups(group GroupConfig, subnets map[string]*ec2.Subnet, svc EC2API) (GroupConfig, []PlanError, error) {
+	errs := make([]PlanError, 0)
+	cache := make(map[string]*ec2.SecurityGroup)
+	resolved := group
+	resolved.Tiers = make([]EC2InstanceTier, 0, len(group.Tiers))
+	for _, tier := range group.Tiers {
+		rt := tier
+		rt.Instances = make([]EC2Instance, 0, len(tier.Instances))
+		for _, inst := range tier.Instances {
+			if len(inst.SecGroups) == 0 {
+				rt.Instances = append(rt.Instances, inst)
+				continue
+			}
+			// without a subnet there's no vpc to look names up in, ids are still checked
+			vpcID := ""
+			if subnet := subnets[inst.Subnet.ID]; subnet != nil {
+				vpcID = aws.StringValue(subnet.VpcId)
+			}
+			ids := make([]string, 0, len(inst.SecGroups))
+			for _, nameOrID := range inst.SecGroups {
+				nameOrID = strings.TrimSpace(nameOrID)
+				if vpcID == "" && !strings.HasPrefix(nameOrID, "sg-") {
+					errs = append(errs, PlanError{Code: PlanErrNoSecGroup, Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("\"%s\" can't be looked up by name, the instance has no subnet to give its vpc", nameOrID)})
+					continue
+				}
+				key := vpcID + "/" + nameOrID
+				sg, looked := cache[key]
+				if !looked {
+					var err error
+					if sg, err = FindSecurityGroup(svc, vpcID, nameOrID); err != nil {
+						return group, nil, err
+					}
+					cache[key] = sg
+				}
+				switch {
+				case sg == nil && vpcID == "":
+					errs = append(errs, PlanError{Code: PlanErrNoSecGroup, Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("\"%s\" does not exist", nameOrID)})
+				case sg == nil:
+					errs = append(errs, PlanError{Code: PlanErrNoSecGroup, Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("\"%s\" does not exist in vpc \"%s\"", nameOrID, vpcID)})
+				case vpcID != "" && aws.StringValue(sg.VpcId) != vpcID:
+					errs = append(errs, PlanError{Code: PlanErrSecGroupVPC, Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("\"%s\" is in vpc \"%s\" but subnet \"%s\" is in vpc \"%s\"", nameOrID, aws.StringValue(sg.VpcId), inst.Subnet.ID, vpcID)})
+				default:
+					ids = append(ids, aws.StringValue(sg.GroupId))
+				}
+			}
+			inst.SecGroups = ids
+			rt.Instances = append(rt.Instances, inst)
+		}
+		resolved.Tiers = append(resolved.Tiers, rt)
+	}
+	return resolved, errs, nil
+}
+
+// util - a copy of the group with every AMI filter resolved to the id of the newest matching image, with errors for
+// filters nothing matches and for AMIs that set both an id and a filter
+func resolveAMIs(group GroupConfig, svc EC2API) (GroupConfig, []PlanError, error) {
+	errs := make([]PlanError, 0)
+	cache := make(map[AMIConfig]string)
+	resolved := group
+	resolved.Tiers = make([]EC2InstanceTier, 0, len(group.Tiers))
+	for _, tier := range group.Tiers {
+		rt := tier
+		rt.Instances = make([]EC2Instance, 0, len(tier.Instances))
+		for _, inst := range tier.Instances {
+			switch {
+			case !inst.AMI.IsFilter():
+			case inst.AMI.ID != "":
+				errs = append(errs, PlanError{Code: PlanErrBadAMI, Tier: tier.Name, Name: inst.Name, Detail: "set either an id or a filter, not both"})
+			case inst.AMI.Owner == "":
+				errs = append(errs, PlanError{Code: PlanErrBadAMI, Tier: tier.Name, Name: inst.Name, Detail: AMIOwnerRequired})
+			default:
+				id, looked := cache[inst.AMI]
+				if !looked {
+					img, err := FindNewestImage(svc, inst.AMI)
+					if err != nil {
+						return group, nil, err
+					}
+					if img != nil {
+						id = aws.StringValue(img.ImageId)
+					}
+					cache[inst.AMI] = id
+				}
+				if id == "" {
+					errs = append(errs, PlanError{Code: PlanErrNoAMI, Tier: tier.Name, Name: inst.Name, Detail: inst.AMI.String()})
+				}
+				inst.AMI.ID = id
+			}
+			rt.Instances = append(rt.Instances, inst)
+		}
+		resolved.Tiers = append(resolved.Tiers, rt)
+	}
+	return resolved, errs, nil
+}
+
+// util - errors for instance profiles that don't exist
+func checkInstanceProfiles(group GroupConfig, svc IAMAPI) ([]PlanError, error) {
+	return checkExists(group, PlanErrNoProfile, func(inst EC2Instance) string {
+		return inst.InstanceProfile
+	}, func(name string) (bool, error) {
+		profile, err := GetInstanceProfile(svc, name)
+		return profile != nil, err
+	})
+}
+
+// util - errors for AMIs given by id that don't exist, filters are checked when they are resolved
+func checkImages(group GroupConfig, svc EC2API) ([]PlanError, error) {
+	return checkExists(group, PlanErrNoAMI, func(inst EC2Instance) string {
+		if inst.AMI.IsFilter() {
+			return ""
+		}
+		return inst.AMI.ID
+	}, func(id string) (bool, error) {
+		img, err := GetImage(svc, id)
+		return img != nil, err
+	})
+}
+
+// util - errors for key pairs that don't exist
+func checkKeyPairs(group GroupConfig, svc EC2API) ([]PlanError, error) {
+	return checkExists(group, PlanErrNoKeyPair, func(inst EC2Instance) string {
+		return inst.KeyName
+	}, func(name string) (bool, error) {
+		kp, err := GetKeyPair(svc, name)
+		return kp != nil, err
+	})
+}
+
+// util - errors for route53 hosted zones that don't exist
+func checkHostedZones(group GroupConfig, svc Route53API) ([]PlanError, error) {
+	return checkExists(group, PlanErrNoHostedZone, func(inst EC2Instance) string {
+		if inst.Route53FQDN() == "" {
+			return ""
+		}
+		return inst.Route53.ZoneID
+	}, func(zoneID string) (bool, error) {
+		zone, err := GetHostedZone(svc, zoneID)
+		return zone != nil, err
+	})
+}
+
+// util - an error with the given code for each instance referring to something that doesn't exist, ref gives what an
+// instance refers to (empty for nothing) and each reference is only looked up once
+func checkExists(group GroupConfig, code PlanErrorCode, ref func(EC2Instance) string, lookup func(string) (bool, error)) ([]PlanError, error) {
+	errs := make([]PlanError, 0)
+	found := make(map[string]bool)
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			key := ref(inst)
+			if key == "" {
+				continue
+			}
+			exists, looked := found[key]
+			if !looked {
+				var err error
+				if exists, err = lookup(key); err != nil {
+					return nil, err
+				}
+				found[key] = exists
+			}
+			if !exists {
+				errs = append(errs, PlanError{Code: code, Tier: tier.Name, Name: inst.Name, Detail: key})
+			}
+		}
+	}
+	return errs, nil
+}
+
+// util - errors for elastic IPs that don't exist or are already associated, being associated with the live instance
+// of the same name (an apply being resumed) is fine
+func checkAddresses(group GroupConfig, instances []ec2.Instance, svc EC2API) ([]PlanError, error) {
+	addrs := make(map[string]*ec2.Address)
+	errs, err := checkExists(group, PlanErrNoAddress, func(inst EC2Instance) string {
+		return inst.ElasticIPID
+	}, func(id string) (bool, error) {
+		addr, err := GetAddress(svc, id)
+		addrs[id] = addr
+		return addr != nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// being associated with the live instance of the same name (an apply being resumed) is fine
+	names := make(map[string]string)
+	for _, inst := range instances {
+		names[aws.StringValue(inst.InstanceId)] = GetInstanceTag(TagName, inst)
+	}
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			addr := addrs[inst.ElasticIPID]
+			if addr == nil || aws.StringValue(addr.AssociationId) == "" || names[aws.StringValue(addr.InstanceId)] == inst.Name {
+				continue
+			}
+			holder := aws.StringValue(addr.InstanceId)
+			if holder == "" {
+				holder = aws.StringValue(addr.NetworkInterfaceId)
+			}
+			errs = append(errs, PlanError{Code: PlanErrAddressInUse, Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("\"%s\" is already associated with %s", inst.ElasticIPID, holder)})
+		}
+	}
+	return errs, nil
+}
+
+// util - dry run the first instance each tier launches, errors for the ones EC2 says would fail (e.g. missing
+// permissions), other errors (e.g. no network) fail the plan
+func dryRunLaunches(plan Plan, base BaseConfig, svc EC2API) ([]PlanError, error) {
+	errs := make([]PlanError, 0)
+	instanceData := make(map[string]EC2InstanceLive)
+	for _, tier := range plan.Group.Tiers {
+		launch := plan.TierToLaunch(tier)
+		if len(launch.Instances) > 0 {
+			// launched with the user data it will really have, earlier tiers are placeholders like a noop run
+			rc := RunConfig{BaseConfig: base, Group: plan.Group, Tier: launch}
+			inst := launch.Instances[0]
+			userData, err := renderUserData(rc, inst, instanceData)
+			if err != nil {
+				errs = append(errs, PlanError{Code: PlanErrUserData, Tier: tier.Name, Name: inst.Name, Detail: err.Error()})
+			} else {
+				inst.UserData = base64.StdEncoding.EncodeToString([]byte(userData))
+				err = DryRunInstance(svc, rc, inst)
+				if aerr, ok := err.(awserr.Error); ok {
+					errs = append(errs, PlanError{Code: PlanErrDryRun, Tier: tier.Name, Name: inst.Name, Detail: aerr.Code() + ": " + aerr.Message()})
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+		addPlaceholderInstances(tier, instanceData)
+	}
+	return errs, nil
+}
+
+// GroupInstancesByTier - live instances grouped by their tier, configured tiers first in order then any only known from
+// live tags, instances with no tier at all are under ""
+func GroupInstancesByTier(group GroupConfig, instances []LiveInstance) ([]string, map[string][]LiveInstance) {
+	order := make([]string, 0, len(group.Tiers))
+	for _, tier := range group.Tiers {
+		order = append(order, tier.Name)
+	}
+	byTier := make(map[string][]LiveInstance)
+	extra := make([]string, 0)
+	for _, li := range instances {
+		if _, seen := byTier[li.Tier]; !seen && !containsString(order, li.Tier) {
+			extra = append(extra, li.Tier)
+		}
+		byTier[li.Tier] = append(byTier[li.Tier], li)
+	}
+	sort.Strings(extra)
+	tiers := make([]string, 0, len(order)+len(extra))
+	for _, tier := range append(order, extra...) {
+		if len(byTier[tier]) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers, byTier
+}
+
+// util - a live instance's tier, from its tier tag or (for instances launched before the tag existed) the config
+func instanceTier(inst ec2.Instance, tiers map[string]string) string {
+	if tier := GetInstanceTag(TagTier, inst); tier != "" {
+		return tier
+	}
+	return tiers[GetInstanceTag(TagName, inst)]
+}
+
+// util - only instances that are up (or on their way up) can be resumed
+func resumable(inst ec2.Instance) bool {
+	return stateClass(aws.StringValue(inst.State.Name)) == stateRunning
+}
+
+func planInstance(action PlanAction, tier string, inst ec2.Instance) PlanInstance {
+	return PlanInstance{
+		Action:     action,
+		Tier:       tier,
+		Name:       GetInstanceTag(TagName, inst),
+		InstanceID: aws.StringValue(inst.InstanceId),
+		State:      aws.StringValue(inst.State.Name),
+	}
+}
+
+// the state classes a plan acts on, an instance moving within a class doesn't change the plan
+const (
+	stateRunning    = "running"
+	stateTerminated = "terminated"
+	stateOther      = "other"
+)
+
+// util - the class of an instance state, pending counts as running and shutting-down as terminated
+func stateClass(state string) string {
+	switch state {
+	case ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning:
+		return stateRunning
+	case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+		return stateTerminated
+	default:
+		return stateOther
+	}
+}
+
+// LiveInstances - the bits of a group's live instances a plan is based on
+func LiveInstances(group GroupConfig, instances []ec2.Instance) []LiveInstance {
+	tiers := make(map[string]string)
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			tiers[inst.Name] = tier.Name
+		}
+	}
+	live := make([]LiveInstance, 0, len(instances))
+	for _, inst := range instances {
+		live = append(live, LiveInstance{
+			InstanceID: aws.StringValue(inst.InstanceId),
+			Name:       GetInstanceTag(TagName, inst),
+			Tier:       instanceTier(inst, tiers),
+			State:      aws.StringValue(inst.State.Name),
+		})
+	}
+	return live
+}
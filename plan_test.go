@@ -0,0 +1,523 @@
+package terrafire
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// util - launch an instance of the group straight through the fake, tagged like terrafire tags it
+func runTestInstance(t *testing.T, svc EC2API, group GroupConfig, tier EC2InstanceTier, inst EC2Instance) string {
+	res, err := svc.RunInstances(createRunInstanceInput(RunConfig{Group: group, Tier: tier}, inst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(res.Instances[0].InstanceId)
+}
+
+func TestCreatePlan(t *testing.T) {
+	svc := NewFakeEC2(nil)
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1"}, {Name: "web2"}}}}}
+	id := runTestInstance(t, svc, group, group.Tiers[0], group.Tiers[0].Instances[1])
+
+	plan, err := CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlanInstance{
+		{Action: PlanActionCreate, Tier: "web", Name: "web1"},
+		{Action: PlanActionConflict, Tier: "web", Name: "web2", InstanceID: id, State: "running"},
+	}
+	if len(plan.Instances) != len(want) || plan.Instances[0] != want[0] || plan.Instances[1] != want[1] {
+		t.Errorf("instances = %v, want %v", plan.Instances, want)
+	}
+	if len(plan.Errors) != 1 || plan.Errors[0].Code != PlanErrInstanceExists || plan.Errors[0].Name != "web2" {
+		t.Errorf("errors = %v, want web2 already exists", plan.Errors)
+	}
+	if plan.OK() {
+		t.Error("a plan with errors is OK")
+	}
+}
+
+func TestCreatePlanEmptyTier(t *testing.T) {
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web"}}}
+	if _, err := CreatePlan(BaseConfig{}, group, Services{EC2: NewFakeEC2(nil)}, PlanOptions{}); err != ErrEmptyTier {
+		t.Errorf("error = %v, want ErrEmptyTier", err)
+	}
+}
+
+func TestCreateDestroyPlanRecords(t *testing.T) {
+	state := NewFakeState()
+	svcs := Services{EC2: NewFakeEC2(state), Route53: NewFakeRoute53(state)}
+	r53 := Route53Config{RecordType: "A", ZoneID: "Z1", Suffix: "example.com", TTL: 60}
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", Route53: r53},
+		{Name: "web2", Route53: r53},
+	}}}}
+	id := runTestInstance(t, svcs.EC2, group, group.Tiers[0], group.Tiers[0].Instances[0])
+	runTestInstance(t, svcs.EC2, group, group.Tiers[0], group.Tiers[0].Instances[1])
+	upsert := func(name, value string) {
+		params := createRoute53Params(route53.ChangeActionUpsert, "A", "Z1", name, value, 60)
+		if _, err := svcs.Route53.ChangeResourceRecordSets(params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upsert("web1.example.com", aws.StringValue(state.findInstance(id).PrivateIpAddress))
+	upsert("web2.example.com", "192.0.2.1")
+
+	plan, err := CreateDestroyPlan(group, svcs, DestroyScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Records) != 1 || plan.Records[0].Instance != "web1" || plan.Records[0].Name() != "web1.example.com." {
+		t.Fatalf("records = %v, want only web1's, web2's points elsewhere", plan.Records)
+	}
+	if recs := plan.TierRecords("web"); len(recs) != 1 {
+		t.Errorf("web tier records = %v, want web1's", recs)
+	}
+	if recs := plan.TierRecords("db"); len(recs) != 0 {
+		t.Errorf("db tier records = %v, want none", recs)
+	}
+
+	if err := DeleteRoute53Records(svcs.Route53, plan.Records, log.New(ioutil.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if rrs, err := GetRoute53Record(svcs.Route53, group.Tiers[0].Instances[0]); err != nil || rrs != nil {
+		t.Errorf("web1 record after delete = %v (%v), want none", rrs, err)
+	}
+	if rrs, err := GetRoute53Record(svcs.Route53, group.Tiers[0].Instances[1]); err != nil || rrs == nil {
+		t.Errorf("web2 record after delete = %v (%v), want it left alone", rrs, err)
+	}
+}
+
+func TestGetRoute53RecordNeedsType(t *testing.T) {
+	inst := EC2Instance{Name: "web1", Route53: Route53Config{ZoneID: "Z1", Suffix: "example.com"}}
+	if _, err := GetRoute53Record(NewFakeRoute53(nil), inst); err == nil {
+		t.Error("looked up a record without a record type")
+	}
+}
+
+func TestDestroyOrder(t *testing.T) {
+	plan := Plan{
+		Kind:  PlanKindDestroy,
+		Group: GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "db"}, {Name: "app"}, {Name: "web"}}},
+		Instances: []PlanInstance{
+			{Action: PlanActionDestroy, Tier: "web", Name: "web1", InstanceID: "i-1"},
+			{Action: PlanActionDestroy, Tier: "db", Name: "db1", InstanceID: "i-2"},
+			{Action: PlanActionDestroy, Tier: "old", Name: "old1", InstanceID: "i-3"},
+			{Action: PlanActionOrphan, Tier: "app", Name: "app1", InstanceID: "i-4"},
+		},
+	}
+	want := []string{"old", "web", "db"}
+	if got := plan.DestroyOrder(); !reflect.DeepEqual(got, want) {
+		t.Errorf("destroy order = %v, want %v", got, want)
+	}
+	if ids := plan.TierInstanceIDs("db"); !reflect.DeepEqual(ids, []string{"i-2"}) {
+		t.Errorf("db tier ids = %v, want [i-2]", ids)
+	}
+	if ids := plan.TierInstanceIDs("app"); len(ids) != 0 {
+		t.Errorf("app tier ids = %v, want none, its only instance isn't configured", ids)
+	}
+}
+
+func TestCreateDestroyPlanScope(t *testing.T) {
+	svcs := NewSimServices(NewFakeState())
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{
+		{Name: "db", Instances: []EC2Instance{{Name: "db1"}}},
+		{Name: "web", Instances: []EC2Instance{{Name: "web1"}, {Name: "web2"}}},
+	}}
+	runTestInstance(t, svcs.EC2, group, group.Tiers[0], group.Tiers[0].Instances[0])
+	runTestInstance(t, svcs.EC2, group, group.Tiers[1], group.Tiers[1].Instances[0])
+	runTestInstance(t, svcs.EC2, group, group.Tiers[1], group.Tiers[1].Instances[1])
+	runTestInstance(t, svcs.EC2, group, group.Tiers[1], EC2Instance{Name: "web9"})
+
+	cases := []struct {
+		scope   DestroyScope
+		destroy []string
+		errs    []PlanErrorCode
+	}{
+		{DestroyScope{Tier: "db"}, []string{"db1"}, nil},
+		{DestroyScope{Tier: "web"}, []string{"web1", "web2"}, []PlanErrorCode{PlanErrNotConfigured}},
+		{DestroyScope{Instances: []string{"web1"}}, []string{"web1"}, nil},
+		{DestroyScope{Tier: "db", Instances: []string{"web1"}}, nil, []PlanErrorCode{PlanErrUnknownName}},
+		{DestroyScope{Tier: "cache"}, nil, []PlanErrorCode{PlanErrUnknownTier}},
+	}
+	for _, tc := range cases {
+		plan, err := CreateDestroyPlan(group, svcs, tc.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var destroy []string
+		for _, pi := range plan.InstancesWithAction(PlanActionDestroy) {
+			destroy = append(destroy, pi.Name)
+		}
+		var errs []PlanErrorCode
+		for _, pe := range plan.Errors {
+			errs = append(errs, pe.Code)
+		}
+		if !reflect.DeepEqual(destroy, tc.destroy) {
+			t.Errorf("%+v: destroys %v, want %v", tc.scope, destroy, tc.destroy)
+		}
+		if !reflect.DeepEqual(errs, tc.errs) {
+			t.Errorf("%+v: errors %v, want %v", tc.scope, plan.Errors, tc.errs)
+		}
+	}
+}
+
+func TestCreateDestroyPlanAmbiguous(t *testing.T) {
+	svcs := Services{EC2: NewFakeEC2(nil), Route53: NewFakeRoute53(nil)}
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1"}}}}}
+	runTestInstance(t, svcs.EC2, group, group.Tiers[0], group.Tiers[0].Instances[0])
+	runTestInstance(t, svcs.EC2, group, group.Tiers[0], group.Tiers[0].Instances[0])
+
+	whole, err := CreateDestroyPlan(group, svcs, DestroyScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(whole.Errors) != 0 || len(whole.InstancesWithAction(PlanActionDestroy)) != 2 {
+		t.Errorf("whole group destroy = %v, %v, want both copies of web1 and no errors", whole.Instances, whole.Errors)
+	}
+	scoped, err := CreateDestroyPlan(group, svcs, DestroyScope{Instances: []string{"web1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scoped.Errors) != 1 || scoped.Errors[0].Code != PlanErrAmbiguous {
+		t.Errorf("scoped destroy errors = %v, want web1 is ambiguous", scoped.Errors)
+	}
+}
+
+func TestCreatePlanResume(t *testing.T) {
+	svc := NewFakeEC2(nil)
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1"}, {Name: "web2"}}}}}
+	id := runTestInstance(t, svc, group, group.Tiers[0], group.Tiers[0].Instances[0])
+
+	plan, err := CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.OK() {
+		t.Fatalf("resume plan errors = %v, want none", plan.Errors)
+	}
+	if existing := plan.TierExisting("web"); len(existing) != 1 || existing[0].Name != "web1" || existing[0].InstanceID != id {
+		t.Errorf("existing = %v, want web1 (%s)", existing, id)
+	}
+	if launch := plan.TierToLaunch(group.Tiers[0]); len(launch.Instances) != 1 || launch.Instances[0].Name != "web2" {
+		t.Errorf("launching %v, want only web2", launch.Instances)
+	}
+
+	runTestInstance(t, svc, group, group.Tiers[0], group.Tiers[0].Instances[0])
+	plan, err = CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Errors) != 1 || plan.Errors[0].Code != PlanErrAmbiguous {
+		t.Errorf("errors with two web1s = %v, want web1 is ambiguous", plan.Errors)
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	group := GroupConfig{Name: "test", Tags: map[string]string{"team": "ops"}, Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", Tags: map[string]string{TagName: "other", TagLauncher: "me"}},
+	}}}}
+	errs := validateTags(group)
+	if len(errs) != 2 || errs[0].Code != PlanErrReservedTag || errs[0].Detail != TagLauncher || errs[1].Detail != TagName {
+		t.Errorf("errors = %v, want Launcher and Name are reserved", errs)
+	}
+}
+
+func TestGroupInstancesByTier(t *testing.T) {
+	live := func(name, tier string) ec2.Instance {
+		inst := ec2.Instance{State: fakeInstanceState(ec2.InstanceStateNameRunning), Tags: []*ec2.Tag{{Key: aws.String(TagName), Value: aws.String(name)}}}
+		if tier != "" {
+			inst.Tags = append(inst.Tags, &ec2.Tag{Key: aws.String(TagTier), Value: aws.String(tier)})
+		}
+		return inst
+	}
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{
+		{Name: "web", Instances: []EC2Instance{{Name: "web1"}}},
+		{Name: "db", Instances: []EC2Instance{{Name: "db1"}}},
+	}}
+	// db1 is configured in db but was launched into web, web1 predates the tier tag
+	instances := []ec2.Instance{live("old1", "old"), live("db1", "web"), live("web1", ""), live("stray", "")}
+
+	tiers, byTier := GroupInstancesByTier(group, LiveInstances(group, instances))
+	if want := []string{"web", "", "old"}; !reflect.DeepEqual(tiers, want) {
+		t.Errorf("tiers = %v, want %v", tiers, want)
+	}
+	if len(byTier["web"]) != 2 || len(byTier[""]) != 1 || len(byTier["old"]) != 1 {
+		t.Errorf("by tier = %v, want db1 and web1 in web, stray in no tier, old1 in old", byTier)
+	}
+}
+
+func TestCreatePlanResumeTierMismatch(t *testing.T) {
+	svc := NewFakeEC2(nil)
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{
+		{Name: "db", Instances: []EC2Instance{{Name: "db1"}}},
+		{Name: "web", Instances: []EC2Instance{{Name: "web1"}}},
+	}}
+	runTestInstance(t, svc, group, group.Tiers[0], group.Tiers[1].Instances[0])
+
+	plan, err := CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Errors) != 1 || plan.Errors[0].Code != PlanErrTierMismatch || plan.Errors[0].Name != "web1" || plan.Errors[0].Detail != "db" {
+		t.Errorf("errors = %v, want web1 is live in tier db", plan.Errors)
+	}
+	if len(plan.Snapshot) != 1 || plan.Snapshot[0].Tier != "db" {
+		t.Errorf("snapshot = %v, want web1 in the db tier it was launched into", plan.Snapshot)
+	}
+}
+
+func TestCheckPlacement(t *testing.T) {
+	state := NewFakeState()
+	state.AddSubnet("subnet-1", "us-east-1a", SimVPC)
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", Zone: "us-east-1a", Subnet: SubnetConfig{ID: "subnet-1"}},
+		{Name: "web2", Zone: "us-east-1b", Subnet: SubnetConfig{ID: "subnet-1"}},
+		{Name: "web3", Subnet: SubnetConfig{ID: "subnet-1"}},
+		{Name: "web4", Zone: "us-east-1b"},
+	}}}}
+	_, subnets, _, err := resolveSubnets(group, NewFakeEC2(state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := checkPlacement(group, subnets)
+	if len(errs) != 1 || errs[0].Code != PlanErrZoneMismatch || errs[0].Name != "web2" {
+		t.Errorf("errors = %v, want only web2's zone mismatch", errs)
+	}
+}
+
+func TestValidateVolumes(t *testing.T) {
+	cases := []struct {
+		volumes []EBSVolume
+		problem string
+	}{
+		{[]EBSVolume{{Device: "/dev/xvdb", Size: 100, Type: ec2.VolumeTypeGp3, IOPS: 4000, Throughput: 250}}, ""},
+		{[]EBSVolume{{Size: 100}}, "every volume needs a device"},
+		{[]EBSVolume{{Device: "/dev/xvdb"}, {Device: "/dev/xvdb"}}, "device /dev/xvdb is used more than once"},
+		{[]EBSVolume{{Device: "/dev/xvdb", Type: ec2.VolumeTypeGp2, Throughput: 250}}, "device /dev/xvdb sets throughput, which is only for gp3"},
+		{[]EBSVolume{{Device: "/dev/xvdb", Type: ec2.VolumeTypeSt1, IOPS: 500}}, "device /dev/xvdb sets iops, which is only for gp3, io1 and io2"},
+		{[]EBSVolume{{Device: "/dev/xvdb", KMSKeyID: "key"}}, "device /dev/xvdb sets a kms key but isn't encrypted"},
+	}
+	for _, tc := range cases {
+		group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "db", Instances: []EC2Instance{{Name: "db1", Volumes: tc.volumes}}}}}
+		errs := validateVolumes(group)
+		switch {
+		case tc.problem == "" && len(errs) != 0:
+			t.Errorf("%v: errors = %v, want none", tc.volumes, errs)
+		case tc.problem != "" && (len(errs) != 1 || errs[0].Code != PlanErrBadVolume || errs[0].Detail != tc.problem):
+			t.Errorf("%v: errors = %v, want %q", tc.volumes, errs, tc.problem)
+		}
+	}
+}
+
+func TestCheckInstanceProfiles(t *testing.T) {
+	state := NewFakeState()
+	state.AddInstanceProfile("web")
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", InstanceProfile: "web"},
+		{Name: "web2", InstanceProfile: "arn:aws:iam::000000000000:instance-profile/web"},
+		{Name: "web3", InstanceProfile: "arn:aws:iam::111111111111:instance-profile/web"},
+		{Name: "web4", InstanceProfile: "nope"},
+		{Name: "web5"},
+	}}}}
+	errs, err := checkInstanceProfiles(group, NewFakeIAM(state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pe := range errs {
+		if pe.Code != PlanErrNoProfile {
+			t.Errorf("error %v, want %s", pe, PlanErrNoProfile)
+		}
+		names = append(names, pe.Name)
+	}
+	if want := []string{"web3", "web4"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("missing profiles for %v, want %v (another account's ARN and an unknown name)", names, want)
+	}
+}
+
+func TestResolveSecurityGroups(t *testing.T) {
+	state := NewFakeState()
+	state.AddSecurityGroup("sg-web", "web", "vpc-1")
+	state.AddSecurityGroup("sg-other", "other", "vpc-2")
+	subnets := map[string]*ec2.Subnet{"subnet-1": {SubnetId: aws.String("subnet-1"), VpcId: aws.String("vpc-1")}}
+	in := func(name string, sgs ...string) EC2Instance {
+		return EC2Instance{Name: name, Subnet: SubnetConfig{ID: "subnet-1"}, SecGroups: sgs}
+	}
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		in("web1", "web", "sg-web"),
+		in("web2", "sg-other"),
+		in("web3", "nope"),
+		{Name: "web4", SecGroups: []string{"web"}},
+		{Name: "web5", SecGroups: []string{"sg-web"}},
+	}}}}
+
+	resolved, errs, err := resolveSecurityGroups(group, subnets, NewFakeEC2(state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts := resolved.Tiers[0].Instances
+	if !reflect.DeepEqual(insts[0].SecGroups, []string{"sg-web", "sg-web"}) || !reflect.DeepEqual(insts[4].SecGroups, []string{"sg-web"}) {
+		t.Errorf("resolved web1 %v and web5 %v, want the names turned into ids", insts[0].SecGroups, insts[4].SecGroups)
+	}
+	want := []PlanError{
+		{Code: PlanErrSecGroupVPC, Tier: "web", Name: "web2"},
+		{Code: PlanErrNoSecGroup, Tier: "web", Name: "web3"},
+		{Code: PlanErrNoSecGroup, Tier: "web", Name: "web4"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("errors = %v, want %v", errs, want)
+	}
+	for idx, pe := range errs {
+		pe.Detail = ""
+		if pe != want[idx] {
+			t.Errorf("error %d = %v, want %v", idx, errs[idx], want[idx])
+		}
+	}
+}
+
+func TestResolveAMIs(t *testing.T) {
+	state := NewFakeState()
+	state.AddImage("ami-1", "self", "base-1", "x86_64", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", AMI: AMIConfig{Owner: "self", Name: "base-*"}},
+		{Name: "web2", AMI: AMIConfig{ID: "ami-2"}},
+		{Name: "web3", AMI: AMIConfig{ID: "ami-2", Owner: "self", Name: "base-*"}},
+		{Name: "web4", AMI: AMIConfig{Name: "base-*"}},
+		{Name: "web5", AMI: AMIConfig{Owner: "self", Name: "nope-*"}},
+	}}}}
+
+	resolved, errs, err := resolveAMIs(group, NewFakeEC2(state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insts := resolved.Tiers[0].Instances; insts[0].AMI.ID != "ami-1" || insts[1].AMI.ID != "ami-2" {
+		t.Errorf("resolved AMIs %s and %s, want the filter pinned to ami-1 and the id left alone", insts[0].AMI.ID, insts[1].AMI.ID)
+	}
+	var got []string
+	for _, pe := range errs {
+		got = append(got, pe.Name+":"+string(pe.Code))
+	}
+	want := []string{"web3:" + string(PlanErrBadAMI), "web4:" + string(PlanErrBadAMI), "web5:" + string(PlanErrNoAMI)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %v, want %v", errs, want)
+	}
+}
+
+func TestResolveSubnets(t *testing.T) {
+	state := NewFakeState()
+	state.AddSubnet("subnet-a", "us-east-1a", "vpc-1")
+	state.AddSubnet("subnet-b", "us-east-1b", "vpc-1")
+	state.AddSubnet("subnet-c", "us-east-1a", "vpc-2")
+	tag := func(key, value string) *ec2.Tag { return &ec2.Tag{Key: aws.String(key), Value: aws.String(value)} }
+	state.Subnets[0].Tags = []*ec2.Tag{tag("Name", "app")}
+	state.Subnets[1].Tags = []*ec2.Tag{tag("Name", "app")}
+	state.Subnets[2].Tags = []*ec2.Tag{tag("Name", "db"), tag("tier", "data")}
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", Zone: "us-east-1b", Subnet: SubnetConfig{Name: "app"}},
+		{Name: "web2", Subnet: SubnetConfig{Name: "app"}},
+		{Name: "web3", Subnet: SubnetConfig{VPC: "vpc-2", Tags: map[string]string{"tier": "data"}}},
+		{Name: "web4", Subnet: SubnetConfig{Name: "nope"}},
+		{Name: "web5", Subnet: SubnetConfig{ID: "subnet-a"}},
+		{Name: "web6", Subnet: SubnetConfig{ID: "subnet-zz"}},
+		{Name: "web7", Subnet: SubnetConfig{ID: "subnet-a", Name: "app"}},
+	}}}}
+
+	resolved, subnets, errs, err := resolveSubnets(group, NewFakeEC2(state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, inst := range resolved.Tiers[0].Instances {
+		ids = append(ids, inst.Subnet.ID)
+	}
+	if want := []string{"subnet-b", "", "subnet-c", "", "subnet-a", "subnet-zz", "subnet-a"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("subnet ids = %v, want %v", ids, want)
+	}
+	if len(subnets) != 3 {
+		t.Errorf("subnets = %v, want a, b and c", subnets)
+	}
+	var got []string
+	for _, pe := range errs {
+		got = append(got, pe.Name+":"+string(pe.Code))
+	}
+	want := []string{"web2:" + string(PlanErrBadSubnet), "web4:" + string(PlanErrNoSubnet), "web6:" + string(PlanErrNoSubnet), "web7:" + string(PlanErrBadSubnet)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %v, want %v", errs, want)
+	}
+}
+
+func TestCreatePlanPreflight(t *testing.T) {
+	state := NewFakeState()
+	state.AddKeyPair("key")
+	state.AddAddress("eipalloc-1", "54.1.1.1")
+	state.AddAddress("eipalloc-2", "54.1.1.2")
+	svcs := Services{EC2: NewFakeEC2(state), Route53: NewFakeRoute53(state)}
+	res, err := svcs.EC2.RunInstances(&ec2.RunInstancesInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svcs.EC2.AssociateAddress(&ec2.AssociateAddressInput{AllocationId: aws.String("eipalloc-1"), InstanceId: res.Instances[0].InstanceId}); err != nil {
+		t.Fatal(err)
+	}
+	r53 := Route53Config{RecordType: "A", ZoneID: "Z9", Suffix: "example.com", TTL: 60}
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", KeyName: "nokey"},
+		{Name: "web2", KeyName: "key", ElasticIPID: "eipalloc-nope"},
+		{Name: "web3", ElasticIPID: "eipalloc-1"},
+		{Name: "web4", ElasticIPID: "eipalloc-2", Route53: r53},
+	}}}}
+
+	plan, err := CreatePlan(BaseConfig{}, group, svcs, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pe := range plan.Errors {
+		got = append(got, pe.Name+":"+string(pe.Code))
+	}
+	want := []string{
+		"web1:" + string(PlanErrNoKeyPair),
+		"web2:" + string(PlanErrNoAddress),
+		"web3:" + string(PlanErrAddressInUse),
+		"web4:" + string(PlanErrNoHostedZone),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %v, want %v", plan.Errors, want)
+	}
+}
+
+func TestCreatePlanDryRun(t *testing.T) {
+	dir := writeTestTemplates(t, map[string]string{
+		"bad.tmpl": "{{.Nope}}",
+		"big.tmpl": "#!/bin/sh\n# {{PrivateIP \"db1\"}}\n" + strings.Repeat("#", 16384),
+		"ok.tmpl":  "#!/bin/sh\n",
+	})
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{
+		{Name: "db", Instances: []EC2Instance{{Name: "db1", Bootstrap: BootTemplates{Content: "bad.tmpl"}}}},
+		{Name: "web", Instances: []EC2Instance{{Name: "web1", Bootstrap: BootTemplates{Content: "big.tmpl"}}}},
+		{Name: "app", Instances: []EC2Instance{{Name: "app1", Bootstrap: BootTemplates{Content: "ok.tmpl"}}}},
+	}}
+
+	plan, err := CreatePlan(BaseConfig{TemplatePath: dir}, group, NewSimServices(NewFakeState()), PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pe := range plan.Errors {
+		got = append(got, pe.Name+":"+string(pe.Code))
+	}
+	want := []string{"db1:" + string(PlanErrUserData), "web1:" + string(PlanErrDryRun)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %v, want %v", plan.Errors, want)
+	}
+}
@@ -0,0 +1,164 @@
+package terrafire
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// LiveInstance - the bits of a live instance a saved plan was based on
+type LiveInstance struct {
+	InstanceID string
+	Name       string
+	Tier       string // from the tier tag, or the config for instances launched before the tag existed
+	State      string
+}
+
+// StalePlanError - a saved plan no longer matches the config or the live state
+type StalePlanError struct {
+	Reasons []string
+}
+
+func (e StalePlanError) Error() string {
+	return "saved plan is stale, re-run plan: " + strings.Join(e.Reasons, "; ")
+}
+
+// HashGroupConfig - a stable hash of a group's configuration
+func HashGroupConfig(group GroupConfig) (string, error) {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return "", fmt.Errorf("could not hash group '%s': %s", group.Name, err)
+	}
+	return hashBytes(data), nil
+}
+
+// UserDataHashes - hash of every instance's user data, rendered with the same placeholder live data as a noop run
+func UserDataHashes(base BaseConfig, group GroupConfig) (map[string]string, error) {
+	hashes := make(map[string]string)
+	instanceData := make(map[string]EC2InstanceLive)
+	for _, tier := range group.Tiers {
+		rc := RunConfig{BaseConfig: base, Group: group, Tier: tier}
+		for _, inst := range tier.Instances {
+			userData, err := createInstanceUserData(rc, inst, instanceData)
+			if err != nil {
+				return nil, fmt.Errorf("instance '%s' user data: %s", inst.Name, err)
+			}
+			hashes[inst.Name] = hashBytes([]byte(userData))
+		}
+		addPlaceholderInstances(tier, instanceData)
+	}
+	return hashes, nil
+}
+
+// util - add placeholder live data for a tier's instances, later tiers see these just like after RunInstancesNoop/GetInstancesNoop
+func addPlaceholderInstances(tier EC2InstanceTier, instanceData map[string]EC2InstanceLive) {
+	for _, inst := range tier.Instances {
+		fake := createFakeEC2Instance(inst)
+		live := EC2InstanceLive{EC2Instance: inst}
+		live.PrivateIpAddress = *fake.PrivateIpAddress
+		live.PrivateDnsName = *fake.PrivateDnsName
+		if fake.PublicIpAddress != nil {
+			live.PublicIpAddress = *fake.PublicIpAddress
+			live.PublicDnsName = *fake.PublicDnsName
+		}
+		instanceData[inst.Name] = live
+	}
+}
+
+// SavePlan - write a plan to a file as JSON
+func SavePlan(path string, plan Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// LoadPlan - read a plan written by SavePlan
+func LoadPlan(path string) (Plan, error) {
+	plan := Plan{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return plan, fmt.Errorf("could not read plan '%s': %s", path, err)
+	}
+	return plan, nil
+}
+
+// VerifyAgainst - check a saved plan against a freshly created one, any difference in config, user data or live state is a StalePlanError
+func (p Plan) VerifyAgainst(current Plan) error {
+	reasons := make([]string, 0)
+	if p.Kind != current.Kind {
+		reasons = append(reasons, fmt.Sprintf("plan is a %s plan, not %s", p.Kind, current.Kind))
+	}
+	if p.Group.Name != current.Group.Name {
+		reasons = append(reasons, fmt.Sprintf("plan is for group '%s', not '%s'", p.Group.Name, current.Group.Name))
+	}
+	if p.Resume != current.Resume {
+		reasons = append(reasons, fmt.Sprintf("plan was made with resume %t, not %t", p.Resume, current.Resume))
+	}
+	// the saved group has its names resolved to ids, so it's checked against the group the fresh plan resolved
+	saved, err := HashGroupConfig(p.Group)
+	resolved, rerr := HashGroupConfig(current.Group)
+	if p.ConfigHash != current.ConfigHash {
+		reasons = append(reasons, "group config has changed")
+	} else if err != nil || rerr != nil || saved != resolved {
+		reasons = append(reasons, "plan's group doesn't match the one resolved from the config, the plan file was edited or a resource has changed")
+	}
+	for _, name := range changedKeys(p.UserData, current.UserData) {
+		reasons = append(reasons, fmt.Sprintf("user data for '%s' has changed", name))
+	}
+	if !sameSnapshot(p.Snapshot, current.Snapshot) {
+		reasons = append(reasons, "live instances in the group have changed")
+	}
+	if len(reasons) > 0 {
+		return StalePlanError{Reasons: reasons}
+	}
+	return nil
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// util - sorted keys whose values differ (or are missing) between two maps
+func changedKeys(a, b map[string]string) []string {
+	keys := make([]string, 0)
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// util - whether two snapshots hold the same instances, states are compared by class (see stateClass)
+func sameSnapshot(a, b []LiveInstance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	byID := make(map[string]LiveInstance, len(a))
+	for _, li := range a {
+		byID[li.InstanceID] = li
+	}
+	for _, li := range b {
+		other, ok := byID[li.InstanceID]
+		if !ok || other.Name != li.Name || stateClass(other.State) != stateClass(li.State) {
+			return false
+		}
+	}
+	return true
+}
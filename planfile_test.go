@@ -0,0 +1,151 @@
+package terrafire
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSaveAndLoadPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrafire-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plan.json")
+
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1"}}}}}
+	plan, err := CreatePlan(BaseConfig{}, group, Services{EC2: NewFakeEC2(nil)}, PlanOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SavePlan(path, plan); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, plan) {
+		t.Errorf("loaded plan = %+v, want %+v", loaded, plan)
+	}
+	if !loaded.Resume {
+		t.Error("the saved plan lost that it resumes")
+	}
+}
+
+func TestVerifyAgainst(t *testing.T) {
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1"}}}}}
+	svc := NewFakeEC2(nil)
+	saved, err := CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.VerifyAgainst(saved); err != nil {
+		t.Errorf("a plan doesn't match itself: %s", err)
+	}
+
+	group = GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1", Type: "t3.large"}}}}}
+	runTestInstance(t, svc, group, group.Tiers[0], EC2Instance{Name: "web2"})
+	current, err := CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.UserData = map[string]string{"web1": "changed"}
+
+	err = saved.VerifyAgainst(current)
+	stale, ok := err.(StalePlanError)
+	if !ok {
+		t.Fatalf("error = %v, want a StalePlanError", err)
+	}
+	want := []string{
+		"plan was made with resume false, not true",
+		"group config has changed",
+		"user data for 'web1' has changed",
+		"live instances in the group have changed",
+	}
+	if !reflect.DeepEqual(stale.Reasons, want) {
+		t.Errorf("reasons = %q, want %q", stale.Reasons, want)
+	}
+}
+
+func TestVerifyAgainstEditedGroup(t *testing.T) {
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1"}}}}}
+	saved, err := CreatePlan(BaseConfig{}, group, Services{EC2: NewFakeEC2(nil)}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := saved
+	edited.Group = GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1", Type: "t3.large"}}}}}
+	err = edited.VerifyAgainst(saved)
+	stale, ok := err.(StalePlanError)
+	if !ok {
+		t.Fatalf("error = %v, want a StalePlanError", err)
+	}
+	want := []string{"plan's group doesn't match the one resolved from the config, the plan file was edited or a resource has changed"}
+	if !reflect.DeepEqual(stale.Reasons, want) {
+		t.Errorf("reasons = %q, want %q", stale.Reasons, want)
+	}
+}
+
+func TestVerifyAgainstResolvedGroup(t *testing.T) {
+	state := NewFakeState()
+	state.AddSubnet("subnet-1", "us-east-1a", "vpc-1")
+	state.AddSecurityGroup("sg-web", "web", "vpc-1")
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", Subnet: SubnetConfig{ID: "subnet-1"}, SecGroups: []string{"web"}},
+	}}}}
+	saved, err := CreatePlan(BaseConfig{}, group, Services{EC2: NewFakeEC2(state)}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sgs := saved.Group.Tiers[0].Instances[0].SecGroups; !reflect.DeepEqual(sgs, []string{"sg-web"}) {
+		t.Fatalf("saved security groups = %v, want the name resolved", sgs)
+	}
+	current, err := CreatePlan(BaseConfig{}, group, Services{EC2: NewFakeEC2(state)}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.VerifyAgainst(current); err != nil {
+		t.Errorf("resolved plan should verify against a fresh one, got %v", err)
+	}
+}
+
+func TestVerifyAgainstStateClass(t *testing.T) {
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{{Name: "web1"}, {Name: "web2"}}}}}
+	state := NewFakeState()
+	svc := NewFakeEC2(state)
+	web1 := runTestInstance(t, svc, group, group.Tiers[0], EC2Instance{Name: "web1"})
+	web2 := runTestInstance(t, svc, group, group.Tiers[0], EC2Instance{Name: "web2"})
+	state.findInstance(web1).State = fakeInstanceState(ec2.InstanceStateNamePending)
+	state.findInstance(web2).State = fakeInstanceState(ec2.InstanceStateNameShuttingDown)
+	saved, err := CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pending -> running and shutting-down -> terminated don't change what the plan does
+	state.findInstance(web1).State = fakeInstanceState(ec2.InstanceStateNameRunning)
+	state.findInstance(web2).State = fakeInstanceState(ec2.InstanceStateNameTerminated)
+	current, err := CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.VerifyAgainst(current); err != nil {
+		t.Errorf("plan is stale after a transition within a state class: %s", err)
+	}
+
+	state.findInstance(web1).State = fakeInstanceState(ec2.InstanceStateNameStopped)
+	current, err = CreatePlan(BaseConfig{}, group, Services{EC2: svc}, PlanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved.VerifyAgainst(current).(StalePlanError); !ok {
+		t.Errorf("plan isn't stale after running -> stopped")
+	}
+}
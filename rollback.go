@@ -0,0 +1,49 @@
+package terrafire
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// RollbackReport - what a rollback cleaned up, and what it couldn't
+type RollbackReport struct {
+	Terminated []string
+	Deleted    []string
+	Failed     []string
+}
+
+// OK - true if everything was cleaned up
+func (rr RollbackReport) OK() bool {
+	return len(rr.Failed) == 0
+}
+
+// Rollback - delete the route53 records and terminate the instances created by a failed apply, carrying on past failures
+func Rollback(svcs Services, instanceIDs []string, records []PlanRecord, logger *log.Logger) RollbackReport {
+	report := RollbackReport{Terminated: []string{}, Deleted: []string{}, Failed: []string{}}
+
+	// records first, they point at the instances
+	for _, rec := range records {
+		desc := fmt.Sprintf("%s (route53 %s record)", rec.Name(), aws.StringValue(rec.RecordSet.Type))
+		if err := DeleteRoute53Records(svcs.Route53, []PlanRecord{rec}, logger); err != nil {
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", desc, err))
+			continue
+		}
+		report.Deleted = append(report.Deleted, desc)
+	}
+
+	// try all the instances at once, then one at a time to find the ones that won't go
+	if err := TerminateInstances(svcs.EC2, instanceIDs, logger); err == nil {
+		report.Terminated = append(report.Terminated, instanceIDs...)
+		return report
+	}
+	for _, id := range instanceIDs {
+		if err := TerminateInstances(svcs.EC2, []string{id}, logger); err != nil {
+			report.Failed = append(report.Failed, fmt.Sprintf("%s (ec2 instance): %s", id, err))
+			continue
+		}
+		report.Terminated = append(report.Terminated, id)
+	}
+	return report
+}
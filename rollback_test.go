@@ -0,0 +1,65 @@
+package terrafire
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// util - two running instances and a route53 record for the first, as a failed apply leaves them
+func rollbackFixture(t *testing.T, state *FakeState) ([]string, []PlanRecord) {
+	svcs := NewSimServices(state)
+	ids := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		res, err := svcs.EC2.RunInstances(&ec2.RunInstancesInput{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, aws.StringValue(res.Instances[0].InstanceId))
+	}
+	params := createRoute53Params(route53.ChangeActionUpsert, "A", "Z1", "web1.example.com", "10.0.0.4", 60)
+	if _, err := svcs.Route53.ChangeResourceRecordSets(params); err != nil {
+		t.Fatal(err)
+	}
+	rec := PlanRecord{Tier: "web", Instance: "web1", ZoneID: "Z1", RecordSet: params.ChangeBatch.Changes[0].ResourceRecordSet}
+	return ids, []PlanRecord{rec}
+}
+
+func TestRollback(t *testing.T) {
+	state := NewFakeState()
+	ids, records := rollbackFixture(t, state)
+
+	report := Rollback(NewSimServices(state), ids, records, log.New(ioutil.Discard, "", 0))
+	if !report.OK() || len(report.Terminated) != 2 || len(report.Deleted) != 1 {
+		t.Errorf("report = %+v, want both instances terminated and the record deleted", report)
+	}
+	for _, id := range ids {
+		if st := aws.StringValue(state.findInstance(id).State.Name); st != ec2.InstanceStateNameTerminated {
+			t.Errorf("%s is %s, want terminated", id, st)
+		}
+	}
+}
+
+func TestRollbackCarriesOnPastFailures(t *testing.T) {
+	state := NewFakeState()
+	ids, records := rollbackFixture(t, state)
+	state.Fail("ChangeResourceRecordSets", "throttled")
+
+	report := Rollback(NewSimServices(state), ids, records, log.New(ioutil.Discard, "", 0))
+	if report.OK() || len(report.Terminated) != 2 || len(report.Failed) != 1 {
+		t.Errorf("report = %+v, want the record failed and both instances terminated anyway", report)
+	}
+
+	state = NewFakeState()
+	ids, records = rollbackFixture(t, state)
+	state.Fail("TerminateInstances", "throttled")
+
+	report = Rollback(NewSimServices(state), ids, records, log.New(ioutil.Discard, "", 0))
+	if report.OK() || len(report.Deleted) != 1 || len(report.Failed) != 2 {
+		t.Errorf("report = %+v, want the record deleted and each instance failed on its own", report)
+	}
+}
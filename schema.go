@@ -0,0 +1,293 @@
+package terrafire
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError - a problem with the config file itself (an unknown or repeated key, or a value of the wrong type) that
+// decoding would otherwise silently ignore, Key is the path to the mapping or value at fault
+type ConfigError struct {
+	File   string
+	Line   int
+	Key    string // e.g. groups[0].tiers[1].instances[0]
+	Detail string
+}
+
+func (ce ConfigError) Error() string {
+	if ce.Key == "" {
+		return fmt.Sprintf("%s:%d: %s", ce.File, ce.Line, ce.Detail)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", ce.File, ce.Line, ce.Key, ce.Detail)
+}
+
+// CheckConfigFile - check a YAML config file against the config structs, keys are matched like viper does (ignoring
+// case) and values are checked against what decoding accepts, so anything reported here would be dropped or mangled
+func CheckConfigFile(path string) ([]ConfigError, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse config '%s': %s", path, err)
+	}
+	cc := configChecker{file: path, errs: make([]ConfigError, 0)}
+	if len(doc.Content) > 0 {
+		cc.check(doc.Content[0], reflect.TypeOf(BaseConfig{}), "")
+	}
+	return cc.errs, nil
+}
+
+// ConfigSchema - a JSON schema (draft 7) of the config file for editors to validate against, generated from the same
+// struct tags the config is decoded with
+func ConfigSchema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(BaseConfig{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "terrafire config"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// util - walks the YAML nodes of a config file alongside the config types, collecting errors
+type configChecker struct {
+	file string
+	errs []ConfigError
+}
+
+func (cc *configChecker) add(node *yaml.Node, key, detail string) {
+	cc.errs = append(cc.errs, ConfigError{File: cc.file, Line: node.Line, Key: key, Detail: detail})
+}
+
+func (cc *configChecker) check(node *yaml.Node, t reflect.Type, key string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind == yaml.ScalarNode && hasShortForm(t) {
+			return
+		}
+		if node.Kind != yaml.MappingNode {
+			cc.add(node, key, "expected a mapping, got "+describeNode(node))
+			return
+		}
+		cc.checkStruct(node, t, key, make(map[string]int))
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			cc.add(node, key, "expected a mapping, got "+describeNode(node))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			cc.check(node.Content[i+1], t.Elem(), joinConfigKey(key, node.Content[i].Value))
+		}
+	case reflect.Slice:
+		// a plain string is split on commas
+		if node.Kind == yaml.ScalarNode && t.Elem().Kind() == reflect.String {
+			return
+		}
+		if node.Kind != yaml.SequenceNode {
+			cc.add(node, key, "expected a list, got "+describeNode(node))
+			return
+		}
+		for i, item := range node.Content {
+			cc.check(item, t.Elem(), fmt.Sprintf("%s[%d]", key, i))
+		}
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			cc.add(node, key, "expected a string, got "+describeNode(node))
+		}
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || !isConfigBool(node) {
+			cc.add(node, key, "expected true or false, got "+describeNode(node))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(node.Value, 0, 64); node.Kind != yaml.ScalarNode || err != nil {
+			cc.add(node, key, "expected a whole number, got "+describeNode(node))
+		}
+	}
+}
+
+// util - check the keys of a mapping decoded into a struct, merge keys (<<) are checked as part of the same mapping
+func (cc *configChecker) checkStruct(node *yaml.Node, t reflect.Type, key string, seen map[string]int) {
+	fields := configFields(t)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if k.Value == "<<" {
+			if v.Kind == yaml.AliasNode {
+				v = v.Alias
+			}
+			merged := []*yaml.Node{v}
+			if v.Kind == yaml.SequenceNode {
+				merged = v.Content
+			}
+			for _, m := range merged {
+				if m.Kind == yaml.AliasNode {
+					m = m.Alias
+				}
+				if m.Kind == yaml.MappingNode {
+					cc.checkStruct(m, t, key, seen)
+				}
+			}
+			continue
+		}
+		name := strings.ToLower(k.Value)
+		field, known := fields[name]
+		if !known {
+			detail := fmt.Sprintf("unknown key \"%s\"", k.Value)
+			if guess := closestKey(name, fields); guess != "" {
+				detail = detail + fmt.Sprintf(", did you mean \"%s\"?", guess)
+			}
+			cc.add(k, key, detail)
+			continue
+		}
+		if line, dup := seen[name]; dup {
+			cc.add(k, key, fmt.Sprintf("key \"%s\" is already set on line %d", k.Value, line))
+		}
+		seen[name] = k.Line
+		cc.check(v, field.Type, joinConfigKey(key, k.Value))
+	}
+}
+
+// util - the scalars viper reads as a bool, strconv.ParseBool's plus YAML 1.1's yes/no and on/off in any case
+const configBoolPattern = `^(1|0|[tT]|[fF]|true|True|TRUE|false|False|FALSE|[yY]|[nN]|[yY][eE][sS]|[nN][oO]|[oO][nN]|[oO][fF][fF])$`
+
+var configBoolRegexp = regexp.MustCompile(configBoolPattern)
+
+// util - true if viper reads the scalar as a bool
+func isConfigBool(node *yaml.Node) bool {
+	return node.Tag == "!!bool" || configBoolRegexp.MatchString(node.Value)
+}
+
+// util - the config keys of a struct (its mapstructure tags, lower case as viper has them) and their fields
+func configFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field
+	}
+	return fields
+}
+
+// util - true for the structs that may be given as a plain string, see stringToIDHook
+func hasShortForm(t reflect.Type) bool {
+	return t == reflect.TypeOf(AMIConfig{}) || t == reflect.TypeOf(SubnetConfig{})
+}
+
+// util - the known key closest to a misspelled one, empty if none is close enough to be a likely typo
+func closestKey(name string, fields map[string]reflect.StructField) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	best, bestDist := "", len(name)/3+1
+	for _, k := range keys {
+		if d := editDistance(name, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// util - levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// util - what a node holds, for error messages
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	return fmt.Sprintf("\"%s\"", node.Value)
+}
+
+// util - a child key's path
+func joinConfigKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// util - the JSON schema of a config type
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for name, field := range configFields(t) {
+			props[name] = typeSchema(field.Type)
+		}
+		schema := map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+		if hasShortForm(t) {
+			return map[string]interface{}{"oneOf": []interface{}{map[string]interface{}{"type": "string"}, schema}}
+		}
+		return schema
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Slice:
+		schema := map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+		if t.Elem().Kind() == reflect.String {
+			return map[string]interface{}{"oneOf": []interface{}{schema, map[string]interface{}{"type": "string"}}}
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"anyOf": []interface{}{
+			map[string]interface{}{"type": "boolean"},
+			map[string]interface{}{"type": "integer", "enum": []int{0, 1}},
+			map[string]interface{}{"type": "string", "pattern": configBoolPattern},
+		}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	}
+	return map[string]interface{}{"type": "string"}
+}
@@ -0,0 +1,141 @@
+package terrafire
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// util - check a config file with the given contents, errors without the file name
+func checkTestConfig(t *testing.T, text string) []string {
+	dir, err := ioutil.TempDir("", "terrafire-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	errs, err := CheckConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ce := range errs {
+		got = append(got, ce.Error()[len(path)+1:])
+	}
+	return got
+}
+
+func TestCheckConfigFile(t *testing.T) {
+	valid := `
+debug: yes
+groups:
+  - name: g
+    region: us-east-1
+    tiers:
+      - name: web
+        instances:
+          - name: web01
+            ami: ami-1
+            secgroups: "a, b"
+            assocpublic: On
+            route53:
+              ttl: "60"
+`
+	if errs := checkTestConfig(t, valid); len(errs) != 0 {
+		t.Errorf("errors for a valid config = %q, want none", errs)
+	}
+
+	misspelled := `
+groups:
+  - name: g
+    tiers:
+      - name: web
+        instances:
+          - name: web01
+            elasticip: eipalloc-1
+            nonsense: 1
+`
+	want := []string{
+		`8: groups[0].tiers[0].instances[0]: unknown key "elasticip", did you mean "elasticipid"?`,
+		`9: groups[0].tiers[0].instances[0]: unknown key "nonsense"`,
+	}
+	if errs := checkTestConfig(t, misspelled); !reflect.DeepEqual(errs, want) {
+		t.Errorf("errors = %q, want %q", errs, want)
+	}
+
+	wrongTypes := `
+parallelism: lots
+debug: maybe
+groups:
+  - name: g
+    tags: [a, b]
+`
+	want = []string{
+		`2: parallelism: expected a whole number, got "lots"`,
+		`3: debug: expected true or false, got "maybe"`,
+		`6: groups[0].tags: expected a mapping, got a list`,
+	}
+	if errs := checkTestConfig(t, wrongTypes); !reflect.DeepEqual(errs, want) {
+		t.Errorf("errors = %q, want %q", errs, want)
+	}
+}
+
+func TestConfigSchemaIsCurrent(t *testing.T) {
+	schema, err := ConfigSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := ioutil.ReadFile("terrafire.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(schema), bytes.TrimSpace(committed)) {
+		t.Error("terrafire.schema.json is out of date, regenerate it with: terrafire schema > terrafire.schema.json")
+	}
+}
+
+func TestConfigSchemaBools(t *testing.T) {
+	raw, err := ConfigSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties struct {
+			Debug struct {
+				AnyOf []struct {
+					Type    string
+					Pattern string
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		t.Fatal(err)
+	}
+	pattern := ""
+	for _, alt := range schema.Properties.Debug.AnyOf {
+		if alt.Type == "string" {
+			pattern = alt.Pattern
+		}
+	}
+	if pattern == "" {
+		t.Fatalf("the schema's bools = %+v, want a string form", schema.Properties.Debug)
+	}
+	re := regexp.MustCompile(pattern)
+	for _, value := range []string{"yes", "No", "ON", "off", "y", "true", "FALSE", "t", "1", "maybe", "tRUE", "2", ""} {
+		node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		if re.MatchString(value) != isConfigBool(node) {
+			t.Errorf("%q: schema allows it %t, config check allows it %t", value, re.MatchString(value), isConfigBool(node))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package terrafire
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// OpenSimState - load a file-backed fake state, every change made through the fakes is written back to the file
+func OpenSimState(path string) (*FakeState, error) {
+	state := NewFakeState()
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	state.fresh = err != nil
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("could not read sim state '%s': %s", path, err)
+		}
+		if state.RecordSets == nil {
+			state.RecordSets = make(map[string][]*route53.ResourceRecordSet)
+		}
+	}
+	state.path = path
+	return state, nil
+}
+
+// IsNew - true if the state's file didn't exist when it was opened
+func (fs *FakeState) IsNew() bool {
+	return fs.fresh
+}
+
+// NewSimServices - create services that run against a file-backed fake state
+func NewSimServices(state *FakeState) Services {
+	return Services{
+		EC2:     NewFakeEC2(state),
+		Route53: NewFakeRoute53(state),
+		STS:     NewFakeSTS(state),
+		IAM:     NewFakeIAM(state),
+	}
+}
+
+// SimVPC - the vpc seeded subnets are put in
+const SimVPC = "vpc-00000000000000001"
+
+// SeedGroup - register any resources the group references but the sim doesn't know about yet (elastic IPs, key pairs,
+// route53 hosted zones, instance profiles given by name, subnets by id or selector in the zone of the first instance that
+// uses them, security groups in their vpc and an image for every AMI id or filter), returns what was added
+func (fs *FakeState) SeedGroup(group GroupConfig) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	added := make([]string, 0)
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			if inst.ElasticIPID != "" && fs.findAddress(inst.ElasticIPID) == nil {
+				n := fs.nextID()
+				fs.Addresses = append(fs.Addresses, fakeAddress(inst.ElasticIPID, fmt.Sprintf("52.0.%d.%d", n/250, n%250+4)))
+				added = append(added, "elastic IP "+inst.ElasticIPID)
+			}
+			if inst.InstanceProfile != "" && !strings.HasPrefix(inst.InstanceProfile, "arn:") && fs.findInstanceProfile(inst.InstanceProfile) == nil {
+				fs.Profiles = append(fs.Profiles, fakeInstanceProfile(inst.InstanceProfile))
+				added = append(added, "instance profile "+inst.InstanceProfile)
+			}
+			if inst.KeyName != "" && fs.findKeyPair(inst.KeyName) == nil {
+				fs.KeyPairs = append(fs.KeyPairs, fakeKeyPair(inst.KeyName))
+				added = append(added, "key pair "+inst.KeyName)
+			}
+			if inst.Route53FQDN() != "" && fs.findHostedZone(inst.Route53.ZoneID) == nil {
+				fs.Zones = append(fs.Zones, fakeHostedZone(inst.Route53.ZoneID, inst.Route53.Suffix))
+				added = append(added, "hosted zone "+inst.Route53.ZoneID)
+			}
+			subnet, seeded := fs.seedSubnet(group.Region, inst)
+			if seeded {
+				added = append(added, "subnet "+aws.StringValue(subnet.SubnetId)+" in "+aws.StringValue(subnet.AvailabilityZone))
+			}
+			if inst.AMI.IsFilter() && inst.AMI.ID == "" && inst.AMI.Owner != "" && !fs.hasImage(inst.AMI) {
+				arch := inst.AMI.Architecture
+				if arch == "" {
+					arch = ec2.ArchitectureValuesX8664
+				}
+				name := strings.NewReplacer("*", "sim", "?", "0").Replace(inst.AMI.Name)
+				id := fmt.Sprintf("ami-%017x", fs.nextID())
+				fs.Images = append(fs.Images, fakeImage(id, inst.AMI.Owner, name, arch, time.Now()))
+				added = append(added, "image "+id+" ("+name+")")
+			}
+			if !inst.AMI.IsFilter() && inst.AMI.ID != "" && fs.findImage(inst.AMI.ID) == nil {
+				fs.Images = append(fs.Images, fakeImage(inst.AMI.ID, "000000000000", inst.AMI.ID, ec2.ArchitectureValuesX8664, time.Now()))
+				added = append(added, "image "+inst.AMI.ID)
+			}
+			vpcID := SimVPC
+			if subnet != nil {
+				vpcID = aws.StringValue(subnet.VpcId)
+			}
+			for _, nameOrID := range inst.SecGroups {
+				nameOrID = strings.TrimSpace(nameOrID)
+				if fs.findSecurityGroup(vpcID, nameOrID) != nil {
+					continue
+				}
+				if strings.HasPrefix(nameOrID, "sg-") {
+					fs.SecGroups = append(fs.SecGroups, fakeSecurityGroup(nameOrID, nameOrID, vpcID))
+				} else {
+					fs.SecGroups = append(fs.SecGroups, fakeSecurityGroup(fmt.Sprintf("sg-%017x", fs.nextID()), nameOrID, vpcID))
+				}
+				added = append(added, "security group "+nameOrID+" in "+vpcID)
+			}
+		}
+	}
+	return added, fs.persist()
+}
+
+// util - the instance's subnet and whether it was added because nothing matched its id or selector yet, nil if it has
+// none, caller must hold the lock
+func (fs *FakeState) seedSubnet(region string, inst EC2Instance) (*ec2.Subnet, bool) {
+	sel := inst.Subnet
+	if sel.IsZero() {
+		return nil, false
+	}
+	zone := sel.Zone
+	if zone == "" {
+		zone = inst.Zone
+	}
+	if sel.IsSelector() {
+		filters := make([]*ec2.Filter, 0)
+		add := func(name, value string) {
+			if value != "" {
+				filters = append(filters, &ec2.Filter{Name: aws.String(name), Values: []*string{aws.String(value)}})
+			}
+		}
+		add("tag:Name", sel.Name)
+		add("vpc-id", sel.VPC)
+		add("availability-zone", zone)
+		for k, v := range sel.Tags {
+			add("tag:"+k, v)
+		}
+		for _, subnet := range fs.Subnets {
+			if fakeSubnetMatches(subnet, filters) {
+				return subnet, false
+			}
+		}
+	} else if subnet := fs.findSubnet(sel.ID); subnet != nil {
+		return subnet, false
+	}
+
+	id := sel.ID
+	if id == "" {
+		id = fmt.Sprintf("subnet-%017x", fs.nextID())
+	}
+	if zone == "" {
+		zone = region + "a"
+	}
+	vpcID := SimVPC
+	if sel.VPC != "" {
+		vpcID = sel.VPC
+	}
+	subnet := fakeSubnet(id, zone, vpcID)
+	if sel.Name != "" {
+		subnet.Tags = append(subnet.Tags, &ec2.Tag{Key: aws.String("Name"), Value: aws.String(sel.Name)})
+	}
+	for k, v := range sel.Tags {
+		subnet.Tags = append(subnet.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	fs.Subnets = append(fs.Subnets, subnet)
+	return subnet, true
+}
+
+// util - true if some image matches the filter, caller must hold the lock
+func (fs *FakeState) hasImage(ami AMIConfig) bool {
+	for _, img := range fs.Images {
+		nameOK, _ := path.Match(ami.Name, aws.StringValue(img.Name))
+		if (ami.Owner == "" || ami.Owner == aws.StringValue(img.OwnerId)) && (ami.Name == "" || nameOK) && (ami.Architecture == "" || ami.Architecture == aws.StringValue(img.Architecture)) {
+			return true
+		}
+	}
+	return false
+}
+
+// util - write the state to its file (if any) via a temp file, caller must hold the lock
+func (fs *FakeState) persist() error {
+	if fs.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(fs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), ".terrafire-sim")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
@@ -0,0 +1,101 @@
+package terrafire
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSimStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrafire-sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sim.json")
+
+	group := GroupConfig{Name: "test", Region: "us-east-1", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", ElasticIPID: "eipalloc-1"},
+		{Name: "web2"},
+	}}}}
+
+	state, err := OpenSimState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.IsNew() || len(state.Addresses) != 0 {
+		t.Errorf("a state whose file doesn't exist is new %t with addresses %v, want new and empty", state.IsNew(), state.Addresses)
+	}
+	added, err := state.SeedGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 {
+		t.Errorf("seeded %v, want web1's elastic IP", added)
+	}
+	svc := NewFakeEC2(state)
+	res, err := svc.RunInstances(&ec2.RunInstancesInput{ImageId: aws.String("ami-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenSimState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.IsNew() {
+		t.Error("a state read back from its file is new")
+	}
+	if reopened.findInstance(aws.StringValue(res.Instances[0].InstanceId)) == nil {
+		t.Error("the launched instance wasn't written to the state file")
+	}
+	if added, err := reopened.SeedGroup(group); err != nil || len(added) != 0 {
+		t.Errorf("seeding again added %v (%v), want nothing", added, err)
+	}
+}
+
+func TestOpenSimStateBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrafire-sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sim.json")
+	if err := ioutil.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSimState(path); err == nil {
+		t.Error("opened a state file that isn't JSON")
+	}
+}
+
+func TestSeedGroupSubnetSelector(t *testing.T) {
+	state := NewFakeState()
+	group := GroupConfig{Name: "test", Region: "us-west-2", Tiers: []EC2InstanceTier{{Name: "app", Instances: []EC2Instance{
+		{Name: "app1", Zone: "us-west-2a", Subnet: SubnetConfig{Name: "private", Tags: map[string]string{"tier": "app"}}},
+		{Name: "app2", Zone: "us-west-2c", Subnet: SubnetConfig{Name: "private", Tags: map[string]string{"tier": "app"}}},
+	}}}}
+	added, err := state.SeedGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 {
+		t.Errorf("seeded %v, want a subnet in each zone", added)
+	}
+
+	resolved, _, errs, err := resolveSubnets(group, NewFakeEC2(state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("errors = %v, want the seeded subnets to match their selectors", errs)
+	}
+	insts := resolved.Tiers[0].Instances
+	if insts[0].Subnet.ID == "" || insts[1].Subnet.ID == "" || insts[0].Subnet.ID == insts[1].Subnet.ID {
+		t.Errorf("resolved subnets %q and %q, want one per zone", insts[0].Subnet.ID, insts[1].Subnet.ID)
+	}
+}
@@ -20,10 +20,52 @@ type EC2UserDataTemplateContext struct {
 
 const TEMPLATE_GLOB_PATTERN string = "*.tmpl"
 
-// util - run the template(s) to create the user data to pass to the instance (the bootstrap script)
-func createInstanceUserData(config RunConfig, inst EC2Instance, instanceData map[string]EC2InstanceLive) string {
+// util - run the template(s) to create the user data to pass to the instance (the bootstrap script), an error for a
+// template that can't be parsed, found or rendered
+func createInstanceUserData(config RunConfig, inst EC2Instance, instanceData map[string]EC2InstanceLive) (string, error) {
+	res, err := renderUserData(config, inst, instanceData)
+	if err != nil {
+		return "", err
+	}
+
+	if config.Debug {
+		fmt.Println(res)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(res))
+	return encoded, nil
+}
+
+// util - render the instance's bootstrap template(s), not encoded
+func renderUserData(config RunConfig, inst EC2Instance, instanceData map[string]EC2InstanceLive) (string, error) {
+	if inst.Bootstrap == (BootTemplates{}) {
+		return "", nil
+	}
+
 	// setup template context and functions
 	ctx := EC2UserDataTemplateContext{inst, config.Group.Name, config.Group.PuppetMaster, config.Group.YumRepo, instanceData}
+	templates, terr := parseUserDataTemplates(config.TemplatePath, instanceData)
+	if terr != nil {
+		return "", terr
+	}
+
+	// render all the templates
+	res := ""
+	for _, name := range []string{inst.Bootstrap.Header, inst.Bootstrap.Content, inst.Bootstrap.Footer} {
+		if name == "" {
+			continue
+		}
+		out, rerr := runTemplate(name, templates, ctx)
+		if rerr != nil {
+			return "", rerr
+		}
+		res = res + out
+	}
+	return res, nil
+}
+
+// util - parse all the user data templates under the template path
+func parseUserDataTemplates(templatePath string, instanceData map[string]EC2InstanceLive) (*template.Template, error) {
 	// TODO - define more template funcs based on "EC2InstanceLive"
 	funcMap := template.FuncMap{
 		"PrivateIP": func(s string) string {
@@ -34,39 +76,24 @@ func createInstanceUserData(config RunConfig, inst EC2Instance, instanceData map
 			return ""
 		},
 	}
-	glob := path.Join(config.TemplatePath, TEMPLATE_GLOB_PATTERN)
+	glob := path.Join(templatePath, TEMPLATE_GLOB_PATTERN)
 	templates, terr := template.New("terrafire").Funcs(funcMap).ParseGlob(glob)
 	if terr != nil {
-		panic(terr)
-	}
-
-	// render all the templates
-	res := ""
-	if inst.Bootstrap.Header != "" {
-		res = res + runTemplate(inst.Bootstrap.Header, templates, ctx)
-	}
-	if inst.Bootstrap.Content != "" {
-		res = res + runTemplate(inst.Bootstrap.Content, templates, ctx)
+		return nil, fmt.Errorf("user data templates '%s': %s", glob, terr)
 	}
-	if inst.Bootstrap.Footer != "" {
-		res = res + runTemplate(inst.Bootstrap.Footer, templates, ctx)
-	}
-
-	if config.Debug {
-		fmt.Println(res)
-	}
-
-	encoded := base64.StdEncoding.EncodeToString([]byte(res))
-	return encoded
+	return templates, nil
 }
 
-func runTemplate(name string, templates *template.Template, ctx EC2UserDataTemplateContext) string {
+func runTemplate(name string, templates *template.Template, ctx EC2UserDataTemplateContext) (string, error) {
+	if templates.Lookup(name) == nil {
+		return "", fmt.Errorf("template '%s' not found", name)
+	}
 	var buffy bytes.Buffer
 	w := bufio.NewWriter(&buffy)
 	terr := templates.ExecuteTemplate(w, name, ctx)
 	if terr != nil {
-		panic(terr)
+		return "", terr
 	}
 	w.Flush()
-	return buffy.String()
+	return buffy.String(), nil
 }
@@ -0,0 +1,157 @@
+package terrafire
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationError - a problem with a group's config found without talking to AWS, Tier and Name are empty for
+// problems with the group as a whole
+type ValidationError struct {
+	Tier   string
+	Name   string
+	Detail string
+}
+
+func (ve ValidationError) Error() string {
+	where := "Group"
+	switch {
+	case ve.Name != "":
+		where = "Instance: \"" + ve.Name + "\""
+	case ve.Tier != "":
+		where = "Tier: \"" + ve.Tier + "\""
+	}
+	return where + " " + ve.Detail + "!!"
+}
+
+// ValidateGroup - check a group's config and user data templates offline, everything that would otherwise only be
+// found mid-apply: a missing region, empty tiers, duplicate names or hostnames, incomplete route53 settings, an AMI filter
+// without an owner, an elastic IP together with a public IP, missing bootstrap templates and templates that don't render
+func ValidateGroup(base BaseConfig, group GroupConfig) []ValidationError {
+	errs := make([]ValidationError, 0)
+	if group.Region == "" {
+		errs = append(errs, ValidationError{Detail: "has no region"})
+	}
+	for _, tier := range group.Tiers {
+		if len(tier.Instances) < 1 {
+			errs = append(errs, ValidationError{Tier: tier.Name, Detail: "has no instances"})
+		}
+	}
+
+	// the rest is checked on the expanded instances, the config as written if it can't be expanded
+	expanded, err := ExpandGroup(group)
+	if err != nil {
+		errs = append(errs, ValidationError{Detail: err.Error()})
+		expanded = group
+	}
+	errs = append(errs, validateHostnames(expanded)...)
+	for _, tier := range expanded.Tiers {
+		for _, inst := range tier.Instances {
+			if detail := validateRoute53(inst.Route53); detail != "" {
+				errs = append(errs, ValidationError{Tier: tier.Name, Name: inst.Name, Detail: detail})
+			}
+			if inst.AMI.IsFilter() && inst.AMI.Owner == "" {
+				errs = append(errs, ValidationError{Tier: tier.Name, Name: inst.Name, Detail: "has a bad AMI, " + AMIOwnerRequired})
+			}
+			if inst.ElasticIPID != "" && inst.AssociatePublicIP {
+				errs = append(errs, ValidationError{Tier: tier.Name, Name: inst.Name, Detail: "sets both an elastic IP and assocpublic, use one or the other"})
+			}
+		}
+	}
+	return append(errs, validateTemplates(base, expanded)...)
+}
+
+// util - errors for hostnames used by more than one instance
+func validateHostnames(group GroupConfig) []ValidationError {
+	errs := make([]ValidationError, 0)
+	seen := make(map[string]string)
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			if inst.Hostname == "" {
+				continue
+			}
+			if other, dup := seen[inst.Hostname]; dup {
+				errs = append(errs, ValidationError{Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("hostname \"%s\" is already used by instance \"%s\"", inst.Hostname, other)})
+				continue
+			}
+			seen[inst.Hostname] = inst.Name
+		}
+	}
+	return errs
+}
+
+// util - what's wrong with a route53 config that is partly filled in, empty if it's fine (or not set at all)
+func validateRoute53(r53 Route53Config) string {
+	if r53 == (Route53Config{}) {
+		return ""
+	}
+	missing := make([]string, 0)
+	if r53.RecordType == "" {
+		missing = append(missing, "type")
+	}
+	if r53.ZoneID == "" {
+		missing = append(missing, "zoneid")
+	}
+	if r53.Suffix == "" {
+		missing = append(missing, "suffix")
+	}
+	if r53.TTL <= 0 {
+		missing = append(missing, "ttl")
+	}
+	if len(missing) > 0 {
+		return "route53 is missing " + strings.Join(missing, ", ")
+	}
+	if r53.RecordType != "A" && r53.RecordType != "CNAME" {
+		return "route53 type \"" + r53.RecordType + "\" must be A or CNAME"
+	}
+	return ""
+}
+
+// util - errors for bootstrap templates that don't exist under the template path and for user data that doesn't
+// render, tiers are rendered in order with placeholder live data for the earlier ones just like a plan. The template
+// path is only read if some instance names a bootstrap template.
+func validateTemplates(base BaseConfig, group GroupConfig) []ValidationError {
+	errs := make([]ValidationError, 0)
+	if !usesBootstrap(group) {
+		return errs
+	}
+	templates, err := parseUserDataTemplates(base.TemplatePath, nil)
+	if err != nil {
+		return append(errs, ValidationError{Detail: err.Error()})
+	}
+	instanceData := make(map[string]EC2InstanceLive)
+	for _, tier := range group.Tiers {
+		rc := RunConfig{BaseConfig: base, Group: group, Tier: tier}
+		for _, inst := range tier.Instances {
+			missing := make([]string, 0)
+			for _, name := range []string{inst.Bootstrap.Header, inst.Bootstrap.Content, inst.Bootstrap.Footer} {
+				if name != "" && templates.Lookup(name) == nil {
+					missing = append(missing, name)
+				}
+			}
+			if len(missing) > 0 {
+				sort.Strings(missing)
+				errs = append(errs, ValidationError{Tier: tier.Name, Name: inst.Name, Detail: fmt.Sprintf("bootstrap template(s) %s not found in %s", strings.Join(missing, ", "), base.TemplatePath)})
+				continue
+			}
+			if _, err := renderUserData(rc, inst, instanceData); err != nil {
+				errs = append(errs, ValidationError{Tier: tier.Name, Name: inst.Name, Detail: "user data doesn't render, " + err.Error()})
+			}
+		}
+		addPlaceholderInstances(tier, instanceData)
+	}
+	return errs
+}
+
+// util - true if any instance names a bootstrap header, content or footer template
+func usesBootstrap(group GroupConfig) bool {
+	for _, tier := range group.Tiers {
+		for _, inst := range tier.Instances {
+			if inst.Bootstrap != (BootTemplates{}) {
+				return true
+			}
+		}
+	}
+	return false
+}
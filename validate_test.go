@@ -0,0 +1,95 @@
+package terrafire
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestValidateGroup(t *testing.T) {
+	dir := writeTestTemplates(t, map[string]string{
+		"boot.tmpl": "#!/bin/sh\nhostname {{.Name}}\necho {{PrivateIP \"db1\"}}\n",
+		"bad.tmpl":  "{{.Nope}}",
+	})
+	boot := BootTemplates{Content: "boot.tmpl"}
+	group := GroupConfig{Name: "test", Tiers: []EC2InstanceTier{
+		{Name: "db", Instances: []EC2Instance{
+			{Name: "db1", Hostname: "db", Bootstrap: boot},
+			{Name: "db2", Hostname: "db", Bootstrap: boot},
+		}},
+		{Name: "web", Instances: []EC2Instance{
+			{Name: "web1", Route53: Route53Config{RecordType: "A", ZoneID: "Z1"}},
+			{Name: "web2", AMI: AMIConfig{Name: "base-*"}},
+			{Name: "web3", ElasticIPID: "eipalloc-1", AssociatePublicIP: true},
+			{Name: "web4", Bootstrap: BootTemplates{Content: "nope.tmpl"}},
+			{Name: "web5", Bootstrap: BootTemplates{Content: "bad.tmpl"}},
+		}},
+		{Name: "cache"},
+	}}
+
+	errs := ValidateGroup(BaseConfig{TemplatePath: dir}, group)
+	var got []string
+	for _, ve := range errs {
+		got = append(got, ve.Tier+"/"+ve.Name)
+	}
+	want := []string{"/", "cache/", "db/db2", "web/web1", "web/web2", "web/web3", "web/web4", "web/web5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %v, want ones for %v", errs, want)
+	}
+
+	group.Region = "us-east-1"
+	group.Tiers = group.Tiers[:1]
+	group.Tiers[0].Instances[1].Hostname = "db2"
+	if errs := ValidateGroup(BaseConfig{TemplatePath: dir}, group); len(errs) != 0 {
+		t.Errorf("errors for a good group = %v, want none", errs)
+	}
+}
+
+func TestValidateGroupDoesNotPrintUserData(t *testing.T) {
+	dir := writeTestTemplates(t, map[string]string{"boot.tmpl": "#!/bin/sh\n"})
+	group := GroupConfig{Name: "test", Region: "us-east-1", Tiers: []EC2InstanceTier{{Name: "web", Instances: []EC2Instance{
+		{Name: "web1", Bootstrap: BootTemplates{Content: "boot.tmpl"}},
+	}}}}
+
+	read, write, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = write
+	errs := ValidateGroup(BaseConfig{TemplatePath: dir, Debug: true}, group)
+	os.Stdout = stdout
+	write.Close()
+	out, _ := ioutil.ReadAll(read)
+
+	if len(errs) != 0 {
+		t.Errorf("errors = %v, want none", errs)
+	}
+	if len(out) != 0 {
+		t.Errorf("validate printed %q, want nothing", out)
+	}
+}
+
+func TestValidateGroupWithoutBootstrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terrafire-notemplates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	group := GroupConfig{Name: "test", Region: "us-east-1", Tiers: []EC2InstanceTier{{Name: "app", Instances: []EC2Instance{
+		{Name: "app1", Type: "t3.small"},
+		{Name: "app2", Type: "t3.small"},
+	}}}}
+
+	for _, path := range []string{dir, dir + "/missing"} {
+		if errs := ValidateGroup(BaseConfig{TemplatePath: path}, group); len(errs) != 0 {
+			t.Errorf("errors with template path %s = %v, want none for a group that uses no templates", path, errs)
+		}
+	}
+
+	group.Tiers[0].Instances[1].Bootstrap = BootTemplates{Footer: "footer.tmpl"}
+	if errs := ValidateGroup(BaseConfig{TemplatePath: dir}, group); len(errs) != 1 {
+		t.Errorf("errors = %v, want one for the missing templates once app2 names a footer", errs)
+	}
+}
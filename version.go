@@ -0,0 +1,5 @@
+package terrafire
+
+// Version - the terrafire version, tagged on every instance it launches, set at build time with
+// -ldflags "-X github.com/bschwinn/terrafire.Version=x.y.z"
+var Version = "dev"